@@ -0,0 +1,241 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultReloadInterval is the default time between checks for changed
+// certificate files.
+const DefaultReloadInterval = 5 * time.Second
+
+// Reloader holds a key pair and a CA pool loaded from PEM files, and reloads
+// them when the files change. The files are checked at most once per interval,
+// during handshakes, so rotated certificates are used by new handshakes
+// without restarting. Connections already established are not affected.
+type Reloader struct {
+	rootCert string
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	roots   *x509.CertPool
+	stamps  []fileStamp // files the key pair and CA pool were loaded from
+	checked time.Time   // last time the files were checked
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewReloader loads the root certificate and the key pair, and returns a
+// Reloader checking the files for changes every interval. rootCert may be
+// empty if only the key pair is needed.
+func NewReloader(rootCert, certFile, keyFile string, interval time.Duration) (*Reloader, error) {
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+	r := &Reloader{
+		rootCert: rootCert,
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reloads the files now if they changed. If loading fails, the
+// previous key pair and CA pool are kept.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checked = time.Now()
+	files := []string{r.certFile, r.keyFile}
+	if r.rootCert != "" {
+		files = append(files, r.rootCert)
+	}
+	stamps, err := stat(files...)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && sameStamps(stamps, r.stamps) {
+		return nil
+	}
+	var roots *x509.CertPool
+	if r.rootCert != "" {
+		roots, err = LoadCACerts(r.rootCert)
+		if err != nil {
+			return err
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	// Swap the key pair and CA pool together
+	r.cert, r.roots, r.stamps = &cert, roots, stamps
+	return nil
+}
+
+// maybeReload reloads the files if they were not checked within the interval.
+// Errors are ignored, so a certificate being half written is picked up at a
+// later check.
+func (r *Reloader) maybeReload() {
+	r.mu.RLock()
+	due := time.Since(r.checked) >= r.interval
+	r.mu.RUnlock()
+	if due {
+		r.Reload()
+	}
+}
+
+// Certificate returns the current key pair.
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.maybeReload()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// Roots returns the current CA pool.
+func (r *Reloader) Roots() *x509.CertPool {
+	r.maybeReload()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.roots
+}
+
+// GetCertificate returns the current key pair, for tls.Config.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// GetClientCertificate returns the current key pair, for tls.Config.
+func (r *Reloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// ServerConfig returns a server config like LoadServerCerts does, using the
+// current key pair and verifying client certificates with the current CA
+// pool. As ClientCAs cannot change after the config is in use, each handshake
+// gets a copy of the config with the current pool from GetConfigForClient;
+// the handshake verifies the client certificate itself, so that the verified
+// chains are in the connection state.
+func (r *Reloader) ServerConfig() *tls.Config {
+	config := &tls.Config{
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		GetCertificate: r.GetCertificate,
+	}
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = r.Roots()
+		return c, nil
+	}
+	return config
+}
+
+// ClientConfig returns a client config like LoadClientCerts does, using the
+// current key pair and verifying server certificates with the current CA
+// pool.
+func (r *Reloader) ClientConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName: serverName,
+		// Server certificates are verified by VerifyConnection, as
+		// RootCAs cannot change after the config is in use
+		InsecureSkipVerify:   true,
+		GetClientCertificate: r.GetClientCertificate,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return r.verify(cs.PeerCertificates, cs.ServerName, x509.ExtKeyUsageServerAuth)
+		},
+	}
+}
+
+// verify verifies a peer certificate chain with the current CA pool.
+func (r *Reloader) verify(chain []*x509.Certificate, dnsName string, usage x509.ExtKeyUsage) error {
+	if len(chain) == 0 {
+		return errors.New("no peer certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         r.Roots(),
+		DNSName:       dnsName,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, cert := range chain[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(opts)
+	return err
+}
+
+// LoadReloadingServerCerts loads the server certificates like
+// LoadServerCerts, reloading them when the files change.
+func LoadReloadingServerCerts(rootCert, serverCert, serverKey string, interval time.Duration) (*tls.Config, error) {
+	r, err := NewReloader(rootCert, serverCert, serverKey, interval)
+	if err != nil {
+		return nil, err
+	}
+	return r.ServerConfig(), nil
+}
+
+// LoadReloadingClientCerts loads the client certificates like
+// LoadClientCerts, reloading them when the files change.
+func LoadReloadingClientCerts(rootCert, clientCert, clientKey, serverName string, interval time.Duration) (*tls.Config, error) {
+	r, err := NewReloader(rootCert, clientCert, clientKey, interval)
+	if err != nil {
+		return nil, err
+	}
+	return r.ClientConfig(serverName), nil
+}
+
+func stat(filenames ...string) ([]fileStamp, error) {
+	stamps := make([]fileStamp, len(filenames))
+	for i, fn := range filenames {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return nil, err
+		}
+		stamps[i] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+	}
+	return stamps, nil
+}
+
+func sameStamps(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Author: Cong Ding <dinggnu@gmail.com>
+
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes a certificate for name, signed by parent (self-signed if
+// nil), and its key to dir. It returns the certificate and key.
+func writeCert(t *testing.T, dir, name string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("create certificate error: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key error: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+"_cert.pem"), certPEM, 0600); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+"_key.pem"), keyPEM, 0600); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+// handshake runs a handshake between the configs and returns the serial
+// number of the server certificate.
+func handshake(t *testing.T, server, client *tls.Config) int64 {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tls.Server(c1, server).Handshake()
+	}()
+	conn := tls.Client(c2, client)
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("client handshake error: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("server handshake error: %v", err)
+	}
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name string) string { return filepath.Join(dir, name) }
+	root, rootKey := writeCert(t, dir, "root", 1, nil, nil)
+	writeCert(t, dir, "server", 2, root, rootKey)
+	writeCert(t, dir, "client", 3, root, rootKey)
+
+	server, err := LoadReloadingServerCerts(file("root_cert.pem"), file("server_cert.pem"), file("server_key.pem"), time.Millisecond)
+	if err != nil {
+		t.Fatalf("load server certs error: %v", err)
+	}
+	client, err := LoadReloadingClientCerts(file("root_cert.pem"), file("client_cert.pem"), file("client_key.pem"), "server", time.Millisecond)
+	if err != nil {
+		t.Fatalf("load client certs error: %v", err)
+	}
+	if serial := handshake(t, server, client); serial != 2 {
+		t.Errorf("serial: got %d, want 2", serial)
+	}
+
+	// A rotated certificate is used by new handshakes.
+	writeCert(t, dir, "server", 4, root, rootKey)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(file("server_cert.pem"), later, later)
+	time.Sleep(2 * time.Millisecond)
+	if serial := handshake(t, server, client); serial != 4 {
+		t.Errorf("serial after rotation: got %d, want 4", serial)
+	}
+
+	// A broken file keeps the previous certificate.
+	ioutil.WriteFile(file("server_key.pem"), []byte("garbage"), 0600)
+	time.Sleep(2 * time.Millisecond)
+	if serial := handshake(t, server, client); serial != 4 {
+		t.Errorf("serial after broken key: got %d, want 4", serial)
+	}
+}
+
+func TestReloaderRejectsUnknownCA(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name string) string { return filepath.Join(dir, name) }
+	root, rootKey := writeCert(t, dir, "root", 1, nil, nil)
+	writeCert(t, dir, "server", 2, root, rootKey)
+
+	server, err := LoadReloadingServerCerts(file("root_cert.pem"), file("server_cert.pem"), file("server_key.pem"), 0)
+	if err != nil {
+		t.Fatalf("load server certs error: %v", err)
+	}
+	// A client certificate from another CA is rejected.
+	other := t.TempDir()
+	otherRoot, otherKey := writeCert(t, other, "root", 5, nil, nil)
+	writeCert(t, other, "client", 6, otherRoot, otherKey)
+	client, err := LoadReloadingClientCerts(file("root_cert.pem"), filepath.Join(other, "client_cert.pem"), filepath.Join(other, "client_key.pem"), "server", 0)
+	if err != nil {
+		t.Fatalf("load client certs error: %v", err)
+	}
+	// A real connection, as the alert sent by the server would block on a
+	// net.Pipe while the client is still writing its Finished
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// With TLS 1.3 the client finishes first, then reads the alert
+		conn := tls.Client(c, client)
+		if conn.Handshake() == nil {
+			conn.Read(make([]byte, 1))
+		}
+	}()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	err = tls.Server(c, server).Handshake()
+	if err == nil || !strings.Contains(err.Error(), "unknown authority") {
+		t.Errorf("handshake with unknown client CA: got %v, want unknown authority", err)
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ccding/go-rproxy/certs"
+	"github.com/ccding/go-rproxy/rproxy"
+)
+
+// DefaultShutdownTimeout is the time connections are given to finish on
+// shutdown if the configuration does not set it.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// Grace returns the time connections are given to finish on shutdown.
+func (c *Config) Grace() time.Duration {
+	if c.ShutdownTimeout == 0 {
+		return DefaultShutdownTimeout
+	}
+	return time.Duration(c.ShutdownTimeout)
+}
+
+// OpenLog returns the logger configured by the log section.
+func (c *Config) OpenLog() (*log.Logger, error) {
+	if c.Log.File == "" {
+		return log.New(os.Stderr, "", log.LstdFlags), nil
+	}
+	f, err := os.OpenFile(c.Log.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return log.New(f, "", log.LstdFlags), nil
+}
+
+// NewServer creates a server running all the routes, loading their
+// certificates.
+func (c *Config) NewServer() (*rproxy.Server, error) {
+	logger, err := c.OpenLog()
+	if err != nil {
+		return nil, err
+	}
+	srv := rproxy.NewServer()
+	srv.SetLogger(logger)
+	if c.MaxConns != nil {
+		srv.SetConnLimit(c.MaxConns.build())
+	}
+	for i := range c.Routes {
+		r := &c.Routes[i]
+		rp, err := c.NewRProxy(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := srv.Add(r.Name, rp); err != nil {
+			return nil, err
+		}
+	}
+	return srv, nil
+}
+
+// NewRProxy creates the proxy of a route, loading its certificates.
+func (c *Config) NewRProxy(r *Route) (*rproxy.RProxy, error) {
+	listenProto, listenAddr, _ := splitAddr(r.Listen)
+	backendProto, backendAddr, _ := splitAddr(r.Backends[0])
+	rp := rproxy.NewRProxyWithoutCerts(listenProto, listenAddr, backendProto, backendAddr)
+	for _, b := range r.Backends[1:] {
+		proto, addr, _ := splitAddr(b)
+		rp.AddBackend(proto, addr)
+	}
+	if r.BackendMaxConns != nil {
+		for _, b := range rp.Backends() {
+			b.SetConnLimit(r.BackendMaxConns.build())
+		}
+	}
+	if r.MaxConns != nil {
+		rp.SetConnLimit(r.MaxConns.build())
+	}
+	lb, err := rproxy.NewBalancer(r.Balancer)
+	if err != nil {
+		return nil, fmt.Errorf("route %s: %v", r.Name, err)
+	}
+	rp.SetBalancer(lb)
+	rp.SetVerbose(c.Log.Verbose)
+	if r.Timeouts.Handshake != 0 {
+		rp.SetHandshakeTimeout(time.Duration(r.Timeouts.Handshake))
+	}
+	rp.SetIdleTimeout(time.Duration(r.Timeouts.Idle))
+	rp.SetMaxLifetime(time.Duration(r.Timeouts.MaxLifetime))
+	rp.SetDialTimeout(time.Duration(r.Timeouts.Dial))
+	if r.Timeouts.BackendHandshake != 0 {
+		rp.SetBackendHandshakeTimeout(time.Duration(r.Timeouts.BackendHandshake))
+	}
+	rp.SetDatagramSize(r.DatagramSize)
+	rp.SetMaxUDPSessions(r.MaxSessions)
+	if r.Socket != nil {
+		rp.SetUnixSocket(r.Socket.build())
+	}
+	if rt := r.Retry; rt != nil {
+		rp.SetRetryPolicy(&rproxy.RetryPolicy{
+			Retries:    rt.Retries,
+			Backoff:    time.Duration(rt.Backoff),
+			MaxBackoff: time.Duration(rt.MaxBackoff),
+			Jitter:     rt.Jitter,
+		})
+	}
+	if r.TLS != nil {
+		config, err := r.TLS.load()
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %v", r.Name, err)
+		}
+		rp.SetServerConfig(config)
+	}
+	if r.BackendTLS != nil {
+		config, err := r.BackendTLS.load()
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %v", r.Name, err)
+		}
+		rp.SetClientConfig(config)
+	}
+	for i := range r.SNI {
+		route, err := r.SNI[i].build(r.BackendMaxConns)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %v", r.Name, err)
+		}
+		rp.AddSNIRoute(route)
+	}
+	if len(r.ALPN) > 0 {
+		rp.SetNextProtos(r.ALPN)
+	}
+	for i := range r.ALPNRoutes {
+		ar := &r.ALPNRoutes[i]
+		pool, err := buildPool(ar.Backends, ar.Balancer, ar.BackendTLS, r.BackendMaxConns)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %v", r.Name, err)
+		}
+		rp.AddALPNRoute(ar.Protocol, pool)
+	}
+	rp.SetProxyProtocol(r.ProxyProtocol)
+	if r.ClientAuth != nil {
+		rp.SetCertPolicy(r.ClientAuth.build())
+	}
+	if bl := r.Bandwidth; bl != nil {
+		rp.SetBandwidthLimit(&rproxy.BandwidthLimit{
+			Conn:   rproxy.Bandwidth(bl.Conn),
+			Client: rproxy.Bandwidth(bl.Client),
+			Route:  rproxy.Bandwidth(bl.Route),
+		})
+	}
+	if rl := r.RateLimit; rl != nil {
+		limit := &rproxy.RateLimit{
+			Rate:     rl.Rate,
+			Burst:    rl.Burst,
+			Key:      rl.Key,
+			Policy:   rl.Policy,
+			MaxDelay: time.Duration(rl.MaxDelay),
+		}
+		if limit.Key == "" {
+			limit.Key = rproxy.RateLimitIP
+		}
+		if limit.Policy == "" {
+			limit.Policy = rproxy.RateLimitReject
+		}
+		rp.SetRateLimit(limit)
+	}
+	if r.IPFilter != nil {
+		f, err := r.IPFilter.build()
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %v", r.Name, err)
+		}
+		rp.SetIPFilter(f)
+	}
+	if len(r.AcceptProxyProtocol) > 0 {
+		trusted, err := rproxy.ParseCIDRs(r.AcceptProxyProtocol)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %v", r.Name, err)
+		}
+		rp.SetAcceptProxyProtocol(trusted)
+	}
+	if hc := r.HealthCheck; hc != nil {
+		rp.SetHealthCheck(&rproxy.HealthCheck{
+			Mode:     hc.Mode,
+			Interval: time.Duration(hc.Interval),
+			Timeout:  time.Duration(hc.Timeout),
+			Send:     []byte(hc.Send),
+			Expect:   []byte(hc.Expect),
+		})
+	}
+	return rp, nil
+}
+
+// load loads the server certificates.
+func (t *ServerTLS) load() (*tls.Config, error) {
+	if t.ReloadInterval > 0 {
+		return certs.LoadReloadingServerCerts(t.RootCert, t.Cert, t.Key, time.Duration(t.ReloadInterval))
+	}
+	return certs.LoadServerCerts(t.RootCert, t.Cert, t.Key)
+}
+
+// load loads the client certificates.
+func (t *ClientTLS) load() (*tls.Config, error) {
+	if t.ReloadInterval > 0 {
+		return certs.LoadReloadingClientCerts(t.RootCert, t.Cert, t.Key, t.ServerName, time.Duration(t.ReloadInterval))
+	}
+	return certs.LoadClientCerts(t.RootCert, t.Cert, t.Key, t.ServerName)
+}
+
+// build builds the SNI route, loading its certificates. Its backends are
+// limited by limit, if not nil.
+func (sr *SNIRoute) build(limit *ConnLimit) (*rproxy.SNIRoute, error) {
+	route := &rproxy.SNIRoute{ServerName: sr.ServerName}
+	if sr.ClientAuth != nil {
+		route.CertPolicy = sr.ClientAuth.build()
+	}
+	if len(sr.Backends) > 0 {
+		pool, err := buildPool(sr.Backends, sr.Balancer, sr.BackendTLS, limit)
+		if err != nil {
+			return nil, err
+		}
+		route.Pool = pool
+	}
+	if c := sr.Certificate; c != nil {
+		if c.ReloadInterval > 0 {
+			r, err := certs.NewReloader("", c.Cert, c.Key, time.Duration(c.ReloadInterval))
+			if err != nil {
+				return nil, err
+			}
+			route.GetCertificate = r.GetCertificate
+		} else {
+			cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+			if err != nil {
+				return nil, err
+			}
+			route.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return &cert, nil
+			}
+		}
+	}
+	return route, nil
+}
+
+// buildPool builds a pool of backends, loading their certificates. The
+// backends are limited by limit, if not nil.
+func buildPool(backends []string, balancer string, backendTLS *ClientTLS, limit *ConnLimit) (*rproxy.Pool, error) {
+	lb, err := rproxy.NewBalancer(balancer)
+	if err != nil {
+		return nil, err
+	}
+	pool := rproxy.NewPool(lb)
+	for _, b := range backends {
+		proto, addr, _ := splitAddr(b)
+		b := rproxy.NewBackend(proto, addr)
+		if limit != nil {
+			b.SetConnLimit(limit.build())
+		}
+		pool.Add(b)
+	}
+	if backendTLS != nil {
+		config, err := backendTLS.load()
+		if err != nil {
+			return nil, err
+		}
+		pool.SetClientConfig(config)
+	}
+	return pool, nil
+}
+
+// build builds the certificate policy.
+func (cp *CertPolicy) build() *rproxy.CertPolicy {
+	rules := func(rules []CertRule) []rproxy.CertRule {
+		var built []rproxy.CertRule
+		for _, r := range rules {
+			built = append(built, rproxy.CertRule(r))
+		}
+		return built
+	}
+	return &rproxy.CertPolicy{Allow: rules(cp.Allow), Deny: rules(cp.Deny)}
+}
+
+// build builds the IP filter.
+func (f *IPFilter) build() (*rproxy.IPFilter, error) {
+	allow, err := rproxy.ParseCIDRs(f.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := rproxy.ParseCIDRs(f.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &rproxy.IPFilter{Allow: allow, Deny: deny}, nil
+}
+
+// build builds a limiter.
+func (l *ConnLimit) build() *rproxy.Limiter {
+	return rproxy.NewLimiter(l.Max, l.Queue, time.Duration(l.QueueTimeout))
+}
+
+// build builds the socket file settings.
+func (s *UnixSocket) build() *rproxy.UnixSocket {
+	mode, _ := s.mode()
+	return &rproxy.UnixSocket{Mode: mode, Owner: s.Owner, Group: s.Group}
+}
+
+// mode parses the octal permissions, 0 if not set.
+func (s *UnixSocket) mode() (os.FileMode, error) {
+	if s.Mode == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(s.Mode, 8, 32)
+	if err != nil || os.FileMode(m)&^os.ModePerm != 0 {
+		return 0, fmt.Errorf("invalid mode %q", s.Mode)
+	}
+	return os.FileMode(m), nil
+}
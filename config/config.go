@@ -0,0 +1,320 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+// Package config loads the configuration file of the rproxy command, which
+// describes listeners, backends, TLS material, timeouts, and logging in JSON.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of the rproxy command.
+type Config struct {
+	Log             Log        `json:"log"`
+	ShutdownTimeout Duration   `json:"shutdown_timeout"`
+	MaxConns        *ConnLimit `json:"max_conns"` // for all the routes together
+	Routes          []Route    `json:"routes"`
+}
+
+// Log configures logging.
+type Log struct {
+	File    string `json:"file"`    // log file, standard error if empty
+	Verbose bool   `json:"verbose"` // log all the data sent and received
+}
+
+// Route is a listener forwarding to its backends.
+type Route struct {
+	Name        string       `json:"name"`
+	Listen      string       `json:"listen"`   // proto://addr, proto is tcp, tls, sni, udp, or unix
+	Backends    []string     `json:"backends"` // proto://addr
+	Balancer    string       `json:"balancer"`
+	TLS         *ServerTLS   `json:"tls"`
+	BackendTLS  *ClientTLS   `json:"backend_tls"`
+	Timeouts    Timeouts     `json:"timeouts"`
+	HealthCheck *HealthCheck `json:"health_check"`
+	SNI         []SNIRoute   `json:"sni"`
+	ALPN        []string     `json:"alpn"` // protocols offered by tls listeners
+	ALPNRoutes  []ALPNRoute  `json:"alpn_routes"`
+	// ProxyProtocol is the version, 1 or 2, of the PROXY protocol header
+	// sent to the backends with the client address, none if 0. Version 2
+	// headers also carry the verified client certificate of tls listeners.
+	ProxyProtocol int `json:"proxy_protocol"`
+	// AcceptProxyProtocol lists the networks, such as 10.0.0.0/8, of the
+	// load balancers in front of the listener. Their connections start with
+	// a PROXY protocol header carrying the client address.
+	AcceptProxyProtocol []string `json:"accept_proxy_protocol"`
+	// ClientAuth authorizes the clients of tls listeners by their
+	// certificates.
+	ClientAuth *CertPolicy `json:"client_auth"`
+	// IPFilter allows or denies clients by their addresses. Changes to it
+	// are applied on reload without restarting the listener.
+	IPFilter *IPFilter `json:"ip_filter"`
+	// RateLimit limits the rate of new connections.
+	RateLimit *RateLimit `json:"rate_limit"`
+	// MaxConns limits the concurrent connections of the route, and
+	// BackendMaxConns those of each of its backends.
+	MaxConns        *ConnLimit `json:"max_conns"`
+	BackendMaxConns *ConnLimit `json:"backend_max_conns"`
+	// Bandwidth limits the byte rates of the proxied streams.
+	Bandwidth *BandwidthLimit `json:"bandwidth"`
+	// Retry retries failed backend dials before giving up on the client.
+	Retry *Retry `json:"retry"`
+	// DatagramSize is the size of the largest datagram proxied by udp
+	// listeners, rproxy.DefaultDatagramSize if 0.
+	DatagramSize int `json:"datagram_size"`
+	// MaxSessions is the most sessions open at once on udp listeners,
+	// rproxy.DefaultMaxUDPSessions if 0.
+	MaxSessions int `json:"max_sessions"`
+	// Socket sets the file created by unix listeners.
+	Socket *UnixSocket `json:"socket"`
+}
+
+// ServerTLS is the TLS material of a TLS listener.
+type ServerTLS struct {
+	RootCert string `json:"root_cert"` // CA verifying client certificates
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	// ReloadInterval, if set, is how often the files are checked for
+	// changes, so renewed certificates are used without restarting.
+	ReloadInterval Duration `json:"reload_interval"`
+}
+
+// ClientTLS is the TLS material used to dial TLS backends.
+type ClientTLS struct {
+	RootCert   string `json:"root_cert"` // CA verifying backend certificates
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	ServerName string `json:"server_name"`
+	// ReloadInterval is as in ServerTLS.
+	ReloadInterval Duration `json:"reload_interval"`
+}
+
+// SNIRoute routes the TLS connections asking for a server name to its own
+// backends, or serves them its own certificate, or both.
+type SNIRoute struct {
+	ServerName  string       `json:"server_name"` // such as *.example.com
+	Backends    []string     `json:"backends"`    // route backends if empty
+	Balancer    string       `json:"balancer"`
+	BackendTLS  *ClientTLS   `json:"backend_tls"`
+	Certificate *Certificate `json:"certificate"` // route certificate if nil
+	ClientAuth  *CertPolicy  `json:"client_auth"` // route client_auth if nil
+}
+
+// ALPNRoute routes the TLS connections negotiating an application protocol to
+// its own backends.
+type ALPNRoute struct {
+	Protocol   string     `json:"protocol"` // such as h2 or http/1.1
+	Backends   []string   `json:"backends"`
+	Balancer   string     `json:"balancer"`
+	BackendTLS *ClientTLS `json:"backend_tls"`
+}
+
+// CertPolicy denies the clients whose certificates match any deny rule, and
+// then allows those matching any allow rule, or all if there are none.
+type CertPolicy struct {
+	Allow []CertRule `json:"allow"`
+	Deny  []CertRule `json:"deny"`
+}
+
+// CertRule matches the client certificates whose fields match all its
+// patterns, such as *.example.com.
+type CertRule struct {
+	CommonName string `json:"common_name"`
+	DNSName    string `json:"dns_name"` // any DNS SAN
+	URI        string `json:"uri"`      // any URI SAN
+	OU         string `json:"ou"`       // any organizational unit
+	Issuer     string `json:"issuer"`   // issuer common name or full name
+}
+
+// IPFilter denies the clients in any deny network, and then allows those in
+// any allow network, or all if there are none. Networks are written as
+// 10.0.0.0/8, 2001:db8::/32, or a single address.
+type IPFilter struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// UnixSocket sets the permissions and ownership of the socket file of a unix
+// listener.
+type UnixSocket struct {
+	Mode  string `json:"mode"`  // octal, such as 0660
+	Owner string `json:"owner"` // user name or ID
+	Group string `json:"group"` // group name or ID
+}
+
+// RateLimit limits the rate of new connections with a token bucket.
+type RateLimit struct {
+	Rate     float64  `json:"rate"`      // connections per second
+	Burst    int      `json:"burst"`     // connections allowed at once
+	Key      string   `json:"key"`       // global, ip (default), or cert
+	Policy   string   `json:"policy"`    // reject (default) or delay
+	MaxDelay Duration `json:"max_delay"` // longest delay
+}
+
+// ConnLimit limits the number of concurrent connections. Connections over
+// the limit wait in a queue of the given size for up to the queue timeout,
+// or are rejected at once if the queue size is 0.
+type ConnLimit struct {
+	Max          int      `json:"max"`
+	Queue        int      `json:"queue"`
+	QueueTimeout Duration `json:"queue_timeout"`
+}
+
+// BandwidthLimit limits the byte rates of each connection, of all the
+// connections of each client, and of all the connections of the route.
+type BandwidthLimit struct {
+	Conn   Bandwidth `json:"conn"`
+	Client Bandwidth `json:"client"`
+	Route  Bandwidth `json:"route"`
+}
+
+// Bandwidth is a pair of byte rates in bytes per second, unlimited if 0.
+type Bandwidth struct {
+	Upload   int64 `json:"upload"`   // from the clients
+	Download int64 `json:"download"` // to the clients
+}
+
+// Certificate is a key pair served by a TLS listener.
+type Certificate struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// ReloadInterval is as in ServerTLS.
+	ReloadInterval Duration `json:"reload_interval"`
+}
+
+// Timeouts of a route.
+type Timeouts struct {
+	Handshake        Duration `json:"handshake"`         // client TLS handshake
+	Idle             Duration `json:"idle"`              // no data in either direction
+	MaxLifetime      Duration `json:"max_lifetime"`      // any connection
+	Dial             Duration `json:"dial"`              // backend connect
+	BackendHandshake Duration `json:"backend_handshake"` // backend TLS handshake
+}
+
+// Retry retries failed backend dials with exponential backoff.
+type Retry struct {
+	Retries    int      `json:"retries"`     // dials after the first
+	Backoff    Duration `json:"backoff"`     // before the first retry, then doubled
+	MaxBackoff Duration `json:"max_backoff"` // unlimited if 0
+	Jitter     float64  `json:"jitter"`      // fraction of each wait taken off at random
+}
+
+// HealthCheck configures active health checking of the backends.
+type HealthCheck struct {
+	Mode     string   `json:"mode"` // tcp, tls, or payload
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+	Send     string   `json:"send"`
+	Expect   string   `json:"expect"`
+}
+
+// Duration is a time.Duration written as a string such as "1m30s".
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON writes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Error is an error in a configuration file.
+type Error struct {
+	File string // file name
+	Line int    // line number, starting from 1
+	Path string // path of the offending value, such as routes[0].listen
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", e.File, e.Line, e.Path, e.Msg)
+}
+
+// Load reads and parses the configuration file.
+func Load(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(filename, data)
+}
+
+// Parse parses and validates configuration data read from filename. Unknown
+// fields, values of the wrong type, and invalid settings are all rejected
+// with the line they appear on.
+func Parse(filename string, data []byte) (*Config, error) {
+	p := &parser{file: filename, data: data, lines: make(map[string]int)}
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	c := new(Config)
+	if err := json.Unmarshal(data, c); err != nil {
+		// Not reached, as check rejects what Unmarshal would
+		return nil, &Error{File: filename, Line: 1, Msg: err.Error()}
+	}
+	if err := c.validate(p); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Route returns the route named name, or nil if there is none.
+func (c *Config) Route(name string) *Route {
+	for i := range c.Routes {
+		if c.Routes[i].Name == name {
+			return &c.Routes[i]
+		}
+	}
+	return nil
+}
+
+// splitAddr splits proto://addr into its protocol and address.
+func splitAddr(s string) (proto, addr string, ok bool) {
+	i := strings.Index(s, "://")
+	if i <= 0 || i+3 == len(s) {
+		return "", "", false
+	}
+	return strings.ToLower(s[:i]), s[i+3:], true
+}
+
+// lineOf returns the line number of an offset in data.
+func lineOf(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
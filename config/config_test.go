@@ -0,0 +1,90 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadExample(t *testing.T) {
+	c, err := Load("example.json")
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+	if len(c.Routes) != 4 {
+		t.Fatalf("routes: got %d, want 4", len(c.Routes))
+	}
+	r := c.Route("testapp")
+	if r == nil {
+		t.Fatalf("route testapp not found")
+	}
+	if time.Duration(r.HealthCheck.Interval) != 10*time.Second {
+		t.Errorf("interval: got %v", time.Duration(r.HealthCheck.Interval))
+	}
+	if c.Grace() != 30*time.Second {
+		t.Errorf("grace: got %v", c.Grace())
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{`{"routes": [}`, "test.json:1: "},
+		{"{\n\"rotes\": []\n}", "test.json:2: rotes: unknown field"},
+		{"{\n\"routes\": [\n{\"name\": 1}\n]\n}", "test.json:3: routes[0].name: expected a string, got number 1"},
+		{"{\"shutdown_timeout\":\n\"10\"}", "test.json:2: shutdown_timeout: invalid duration \"10\""},
+		{"{\"routes\": []}", "test.json:1: routes: at least one route is required"},
+		{"{\"routes\": [\n{\"name\": \"a\",\n\"listen\": \"tcp://:1\"}]}", "test.json:2: routes[0].backends: at least one backend is required"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"sni://:1\",\n\"backends\": [\"tls://:2\"]}]}", "test.json:2: routes[0].backends: TLS passthrough requires tcp backends"},
+		{"{\"routes\": [{\"name\": \"a\",\n\"listen\": \"sctp://:1\"}]}", "test.json:2: routes[0].listen: listen protocol \"sctp\" not supported"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"udp://:1\",\n\"backends\": [\"tcp://:2\"]}]}", "test.json:2: routes[0].backends[0]: udp listeners and backends go together"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"udp://:1\", \"backends\": [\"udp://:2\"],\n\"proxy_protocol\": 2}]}", "test.json:2: routes[0].proxy_protocol: not supported for udp listeners"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"tcp://:1\", \"backends\": [\"tcp://:2\"],\n\"datagram_size\": 512}]}", "test.json:2: routes[0].datagram_size: only allowed for udp listeners"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"udp://:1\", \"backends\": [\"udp://:2\"],\n\"max_sessions\": -1}]}", "test.json:2: routes[0].max_sessions: must not be negative"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"unix:///tmp/a.sock\", \"backends\": [\"tcp://:2\"],\n\"accept_proxy_protocol\": [\"10.0.0.0/8\"]}]}", "test.json:2: routes[0].accept_proxy_protocol: not supported for unix listeners"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"unix:///tmp/a.sock\", \"backends\": [\"tcp://:2\"],\n\"ip_filter\": {\"deny\": [\"10.0.0.0/8\"]}}]}", "test.json:2: routes[0].ip_filter: not supported for unix listeners"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"unix:///tmp/a.sock\", \"backends\": [\"tcp://:2\"],\n\"rate_limit\": {\"rate\": 5, \"burst\": 1}}]}", "test.json:2: routes[0].rate_limit.key: ip is not supported for unix listeners"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"unix:///run/a.sock\", \"backends\": [\"unix:///run/b.sock\"],\n\"socket\": {\"mode\": \"0999\"}}]}", "test.json:2: routes[0].socket.mode: expected octal permissions such as 0660, got \"0999\""},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"tcp://:1\", \"backends\": [\"unix:///run/b.sock\"],\n\"socket\": {\"mode\": \"0660\"}}]}", "test.json:2: routes[0].socket: only allowed for unix listeners"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"tls://:1\",\n\"backends\": [\"tcp://:2\"]}]}", "test.json:1: routes[0].tls: required for tls listeners"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"tcp://:1\",\n\"backends\": [\"tcp://:2\",\n\"tls://:3\"]}]}", "test.json:1: routes[0].backend_tls: required"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"tcp://:1\", \"backends\": [\"tcp://:2\"],\n\"balancer\": \"magic\"}]}", "test.json:2: routes[0].balancer: unknown balancer"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"tcp://:1\", \"backends\": [\"tcp://:2\"]},\n{\"name\": \"a\"}]}", "test.json:2: routes[1].name: duplicate route name"},
+		{"{\"log\": {}, \"log\": {}}", "test.json:1: log: duplicate field"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"tcp://:1\", \"backends\": [\"tcp://:2\"],\n\"sni\": [{\"server_name\": \"a\"}]}]}", "test.json:2: routes[0].sni: only allowed for tls and sni listeners"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"sni://:1\", \"backends\": [\"tcp://:2\"],\n\"alpn\": [\"h2\"]}]}", "test.json:2: routes[0].alpn: only allowed for tls listeners"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"tcp://:1\", \"backends\": [\"tcp://:2\"],\n\"proxy_protocol\": 3}]}", "test.json:2: routes[0].proxy_protocol: expected version 1 or 2, got 3"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"tcp://:1\", \"backends\": [\"tcp://:2\"],\n\"retry\": {\"retries\": 2, \"jitter\": 1.5}}]}", "test.json:2: routes[0].retry.jitter: must be from 0 to 1"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"tcp://:1\", \"backends\": [\"tcp://:2\"],\n\"retry\": {\"retries\": 1000}}]}", "test.json:2: routes[0].retry.retries: must be from 0 to 100"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"tcp://:1\", \"backends\": [\"tcp://:2\"],\n\"bandwidth\": {\"client\": {\"download\": -1}}}]}", "test.json:2: routes[0].bandwidth.client.download: must not be negative"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"tcp://:1\", \"backends\": [\"tcp://:2\"],\n\"max_conns\": {\"max\": 1, \"queue\": 1}}]}", "test.json:2: routes[0].max_conns.queue_timeout: must be positive with a queue"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"tcp://:1\", \"backends\": [\"tcp://:2\"],\n\"rate_limit\": {\"rate\": 1, \"burst\": 1,\n\"key\": \"cert\"}}]}", "test.json:3: routes[0].rate_limit.key: cert is only allowed for tls listeners"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"tcp://:1\", \"backends\": [\"tcp://:2\"],\n\"client_auth\": {\"allow\": [{\"ou\": \"a\"}]}}]}", "test.json:2: routes[0].client_auth: only allowed for tls listeners"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"tcp://:1\", \"backends\": [\"tcp://:2\"],\n\"accept_proxy_protocol\": [\"10.0.0.0/8\", \"10.0.0.0/33\"]}]}", "test.json:2: routes[0].accept_proxy_protocol[1]: invalid CIDR address: 10.0.0.0/33"},
+		{"{\"routes\": [{\"name\": \"a\", \"listen\": \"sni://:1\", \"backends\": [\"tcp://:2\"],\n\"alpn_routes\": [{\"protocol\": \"h2\", \"backends\": [\"tcp://:3\"]},\n{\"protocol\": \"h2\", \"backends\": [\"tcp://:4\"]}]}]}", "test.json:3: routes[0].alpn_routes[1].protocol: duplicate protocol \"h2\""},
+	}
+	for _, tt := range tests {
+		_, err := Parse("test.json", []byte(tt.data))
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("parse %q: got %v, want %s...", tt.data, err, tt.want)
+		}
+	}
+}
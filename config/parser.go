@@ -0,0 +1,221 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// parser checks configuration data against the Config type token by token,
+// recording the line of every value so that errors can point at it.
+type parser struct {
+	file  string
+	data  []byte
+	dec   *json.Decoder
+	lines map[string]int // line of each value by path
+}
+
+// errorAt returns an error located at offset.
+func (p *parser) errorAt(offset int64, path, format string, v ...interface{}) error {
+	return &Error{File: p.file, Line: lineOf(p.data, offset), Path: path, Msg: fmt.Sprintf(format, v...)}
+}
+
+// errorf returns an error located at the value at path, or at its closest
+// parent if the value is missing.
+func (p *parser) errorf(path, format string, v ...interface{}) error {
+	return &Error{File: p.file, Line: p.line(path), Path: path, Msg: fmt.Sprintf(format, v...)}
+}
+
+// line returns the line of the value at path or of its closest parent.
+func (p *parser) line(path string) int {
+	for {
+		if line, ok := p.lines[path]; ok {
+			return line
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			return p.lines[""]
+		}
+		path = path[:i]
+	}
+}
+
+// check checks the whole configuration data.
+func (p *parser) check() error {
+	p.dec = json.NewDecoder(bytes.NewReader(p.data))
+	p.dec.UseNumber()
+	if err := p.value(reflect.TypeOf(Config{}), ""); err != nil {
+		return err
+	}
+	if _, err := p.dec.Token(); err != io.EOF {
+		return p.errorAt(p.dec.InputOffset(), "", "unexpected data after the configuration")
+	}
+	return nil
+}
+
+// token reads the next token and returns it with the offset of its end.
+func (p *parser) token(path string) (json.Token, int64, error) {
+	tok, err := p.dec.Token()
+	if err == io.EOF {
+		return nil, 0, p.errorAt(int64(len(p.data)), path, "unexpected end of file")
+	}
+	if err != nil {
+		if se, ok := err.(*json.SyntaxError); ok {
+			return nil, 0, p.errorAt(se.Offset, path, "%v", err)
+		}
+		return nil, 0, p.errorAt(p.dec.InputOffset(), path, "%v", err)
+	}
+	// Step back onto the token, so a value is on the line it ends
+	return tok, p.dec.InputOffset() - 1, nil
+}
+
+// value checks that the next value in the data can be stored in typ.
+func (p *parser) value(typ reflect.Type, path string) error {
+	tok, off, err := p.token(path)
+	if err != nil {
+		return err
+	}
+	p.lines[path] = lineOf(p.data, off)
+	if typ.Kind() == reflect.Ptr {
+		if tok == nil {
+			return nil
+		}
+		typ = typ.Elem()
+	}
+	if typ == durationType {
+		s, ok := tok.(string)
+		if !ok {
+			return p.errorAt(off, path, "expected a duration string such as \"30s\", got %s", describe(tok))
+		}
+		if _, err := time.ParseDuration(s); err != nil {
+			return p.errorAt(off, path, "invalid duration %q", s)
+		}
+		return nil
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		if tok != json.Delim('{') {
+			return p.errorAt(off, path, "expected an object, got %s", describe(tok))
+		}
+		fields := jsonFields(typ)
+		seen := make(map[string]bool)
+		for p.dec.More() {
+			tok, off, err := p.token(path)
+			if err != nil {
+				return err
+			}
+			key := tok.(string)
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			ft, ok := fields[key]
+			if !ok {
+				return p.errorAt(off, fieldPath, "unknown field")
+			}
+			if seen[key] {
+				return p.errorAt(off, fieldPath, "duplicate field")
+			}
+			seen[key] = true
+			if err := p.value(ft, fieldPath); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		if tok != json.Delim('[') {
+			return p.errorAt(off, path, "expected an array, got %s", describe(tok))
+		}
+		for i := 0; p.dec.More(); i++ {
+			if err := p.value(typ.Elem(), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		if _, ok := tok.(string); !ok {
+			return p.errorAt(off, path, "expected a string, got %s", describe(tok))
+		}
+		return nil
+	case reflect.Bool:
+		if _, ok := tok.(bool); !ok {
+			return p.errorAt(off, path, "expected true or false, got %s", describe(tok))
+		}
+		return nil
+	case reflect.Int, reflect.Int64:
+		n, ok := tok.(json.Number)
+		if !ok {
+			return p.errorAt(off, path, "expected an integer, got %s", describe(tok))
+		}
+		if _, err := n.Int64(); err != nil {
+			return p.errorAt(off, path, "expected an integer, got %s", n)
+		}
+		return nil
+	case reflect.Float64:
+		if _, ok := tok.(json.Number); !ok {
+			return p.errorAt(off, path, "expected a number, got %s", describe(tok))
+		}
+		return nil
+	default:
+		panic("config: unsupported field type " + typ.String())
+	}
+	// Consume the closing delimiter
+	_, _, err = p.token(path)
+	return err
+}
+
+// jsonFields returns the types of the fields of a struct by their JSON names.
+func jsonFields(typ reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// describe describes a JSON token for error messages.
+func describe(tok json.Token) string {
+	switch v := tok.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return fmt.Sprint(v)
+	case json.Number:
+		return "number " + v.String()
+	case string:
+		return fmt.Sprintf("string %q", v)
+	case json.Delim:
+		switch v {
+		case '{':
+			return "an object"
+		case '[':
+			return "an array"
+		}
+	}
+	return fmt.Sprint(tok)
+}
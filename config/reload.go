@@ -0,0 +1,141 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/ccding/go-rproxy/rproxy"
+)
+
+// Reload applies the configuration next to srv, which is running cur, and
+// returns the configuration srv runs afterwards.
+//
+// Routes unchanged between cur and next are left untouched along with their
+// connections. Removed and changed routes stop accepting connections at once,
+// and their connections are given the shutdown timeout of next to finish.
+// The routes of next are all built before anything changes, so that a
+// configuration with, for example, a bad certificate is rejected as a whole.
+// A changed route whose replacement fails to listen keeps running as in cur.
+func Reload(srv *rproxy.Server, cur, next *Config) (*Config, error) {
+	logger := srv.Logger()
+	// Build the new and changed routes
+	built := make(map[string]*rproxy.RProxy)
+	for i := range next.Routes {
+		r := &next.Routes[i]
+		if old := cur.Route(r.Name); old != nil && sameRoute(cur, old, next, r) {
+			continue
+		}
+		rp, err := next.NewRProxy(r)
+		if err != nil {
+			return cur, err
+		}
+		built[r.Name] = rp
+	}
+	if next.Log.File != cur.Log.File {
+		logger.Printf("reload: changing the log file requires a restart")
+	}
+	applied := &Config{Log: next.Log, ShutdownTimeout: next.ShutdownTimeout, MaxConns: next.MaxConns}
+	applied.Log.File = cur.Log.File
+	if !reflect.DeepEqual(cur.MaxConns, next.MaxConns) {
+		var l *rproxy.Limiter
+		if next.MaxConns != nil {
+			l = next.MaxConns.build()
+		}
+		srv.SetConnLimit(l)
+		logger.Printf("reload: max_conns changed")
+	}
+
+	// The routes drain in the background, past the return of Reload, so the
+	// context is released once they have shut down
+	ctx, cancel := context.WithTimeout(context.Background(), next.Grace())
+	// Remove the routes first, so that their addresses are free
+	for _, r := range cur.Routes {
+		if next.Route(r.Name) == nil {
+			srv.Remove(ctx, r.Name)
+			logger.Printf("reload: route %s removed", r.Name)
+		}
+	}
+	var errs []string
+	for i := range next.Routes {
+		r := &next.Routes[i]
+		rp, ok := built[r.Name]
+		if !ok {
+			if old := cur.Route(r.Name); !reflect.DeepEqual(old.IPFilter, r.IPFilter) {
+				if err := setIPFilter(srv.Route(r.Name), r.IPFilter); err != nil {
+					errs = append(errs, err.Error())
+					applied.Routes = append(applied.Routes, *old)
+					continue
+				}
+				logger.Printf("reload: route %s ip filter changed", r.Name)
+			}
+			applied.Routes = append(applied.Routes, *r)
+			continue
+		}
+		old := cur.Route(r.Name)
+		if old == nil {
+			if err := srv.Add(r.Name, rp); err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			logger.Printf("reload: route %s added", r.Name)
+			applied.Routes = append(applied.Routes, *r)
+			continue
+		}
+		if err := srv.Replace(ctx, r.Name, rp); err != nil {
+			errs = append(errs, err.Error())
+			applied.Routes = append(applied.Routes, *old)
+			continue
+		}
+		logger.Printf("reload: route %s changed", r.Name)
+		applied.Routes = append(applied.Routes, *r)
+	}
+	drained := srv.Drained()
+	go func() {
+		<-drained
+		cancel()
+	}()
+	if len(errs) > 0 {
+		return applied, fmt.Errorf("reload: %s", strings.Join(errs, "; "))
+	}
+	return applied, nil
+}
+
+// sameRoute reports whether route a of config ca runs the same as route b of
+// config cb, but for the IP filter, which is changed in place.
+func sameRoute(ca *Config, a *Route, cb *Config, b *Route) bool {
+	a2, b2 := *a, *b
+	a2.IPFilter, b2.IPFilter = nil, nil
+	return ca.Log.Verbose == cb.Log.Verbose && reflect.DeepEqual(&a2, &b2)
+}
+
+// setIPFilter sets the IP filter of a running route.
+func setIPFilter(rp *rproxy.RProxy, f *IPFilter) error {
+	if f == nil {
+		rp.SetIPFilter(nil)
+		return nil
+	}
+	built, err := f.build()
+	if err != nil {
+		return err
+	}
+	rp.SetIPFilter(built)
+	return nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package config
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+// freeAddr returns a local address with nothing listening on it.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func parseRoutes(t *testing.T, routes string) *Config {
+	c, err := Parse("test.json", []byte(`{"routes": [`+routes+`]}`))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	return c
+}
+
+func TestReload(t *testing.T) {
+	echo := backendtest.Start(t, nil, backendtest.Echo)
+	route := func(name, listen string) string {
+		return fmt.Sprintf(`{"name": %q, "listen": "tcp://%s", "backends": ["tcp://%s"]}`, name, listen, echo)
+	}
+	addrA, addrB, addrC := freeAddr(t), freeAddr(t), freeAddr(t)
+	cur := parseRoutes(t, route("a", addrA)+","+route("b", addrB))
+	srv, err := cur.NewServer()
+	if err != nil {
+		t.Fatalf("new server error: %v", err)
+	}
+	go srv.Start()
+	defer srv.Close()
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", addrA); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	a := srv.Route("a")
+
+	// A configuration failing to load is rejected as a whole.
+	bad := parseRoutes(t, route("a", addrA)+`,{"name": "b", "listen": "tls://`+addrB+`", "backends": ["tcp://`+echo+`"],
+		"tls": {"root_cert": "missing.pem", "cert": "missing.pem", "key": "missing.pem"}}`)
+	if applied, err := Reload(srv, cur, bad); err == nil || applied != cur {
+		t.Errorf("reload bad config: got %v, want error", err)
+	}
+	if got := srv.Routes(); len(got) != 2 {
+		t.Errorf("routes after bad reload: got %v", got)
+	}
+
+	// Route a is unchanged, b is removed, and c is added.
+	next := parseRoutes(t, route("a", addrA)+","+route("c", addrC))
+	applied, err := Reload(srv, cur, next)
+	if err != nil {
+		t.Fatalf("reload error: %v", err)
+	}
+	if len(applied.Routes) != 2 {
+		t.Errorf("applied routes: got %d, want 2", len(applied.Routes))
+	}
+	if got := srv.Routes(); len(got) != 2 || got[0] != "a" || got[1] != "c" {
+		t.Errorf("routes: got %v", got)
+	}
+	if srv.Route("a") != a {
+		t.Errorf("unchanged route a was replaced")
+	}
+	// The connection through route a is untouched.
+	conn.Write([]byte("x"))
+	buf := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Errorf("read through route a: %v", err)
+	}
+	if _, err := net.Dial("tcp", addrB); err == nil {
+		t.Errorf("dial removed route b succeeded")
+	}
+	if c, err := net.Dial("tcp", addrC); err != nil {
+		t.Errorf("dial added route c: %v", err)
+	} else {
+		c.Close()
+	}
+}
+
+func TestReloadIPFilter(t *testing.T) {
+	echo := backendtest.Start(t, nil, backendtest.Echo)
+	addr := freeAddr(t)
+	route := fmt.Sprintf(`{"name": "a", "listen": "tcp://%s", "backends": ["tcp://%s"]`, addr, echo)
+	cur := parseRoutes(t, route+"}")
+	srv, err := cur.NewServer()
+	if err != nil {
+		t.Fatalf("new server error: %v", err)
+	}
+	go srv.Start()
+	defer srv.Close()
+	rp := srv.Route("a")
+
+	next := parseRoutes(t, route+`, "ip_filter": {"deny": ["127.0.0.0/8"]}}`)
+	applied, err := Reload(srv, cur, next)
+	if err != nil {
+		t.Fatalf("reload error: %v", err)
+	}
+	if srv.Route("a") != rp {
+		t.Errorf("route restarted for an IP filter change")
+	}
+	if f := rp.IPFilter(); f == nil || len(f.Deny) != 1 {
+		t.Errorf("got IP filter %v", f)
+	}
+	if _, err := Reload(srv, applied, cur); err != nil {
+		t.Fatalf("reload error: %v", err)
+	}
+	if srv.Route("a") != rp || rp.IPFilter() != nil {
+		t.Errorf("IP filter not removed")
+	}
+}
+
+func TestReloadChangedRoute(t *testing.T) {
+	echo := backendtest.Start(t, nil, backendtest.Echo)
+	addr, busy := freeAddr(t), backendtest.Start(t, nil, backendtest.Echo)
+	route := func(listen, max string) string {
+		return fmt.Sprintf(`{"name": "a", "listen": "tcp://%s", "backends": ["tcp://%s"], "max_conns": %s}`, listen, echo, max)
+	}
+	cur := parseRoutes(t, route(addr, `{"max": 10}`))
+	srv, err := cur.NewServer()
+	if err != nil {
+		t.Fatalf("new server error: %v", err)
+	}
+	go srv.Start()
+	defer srv.Close()
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	echoByte := func() error {
+		conn.Write([]byte("x"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := io.ReadFull(conn, make([]byte, 1))
+		return err
+	}
+	if err := echoByte(); err != nil {
+		t.Fatalf("read through route a: %v", err)
+	}
+	rp := srv.Route("a")
+
+	// A changed route failing to listen keeps the old one running.
+	applied, err := Reload(srv, cur, parseRoutes(t, route(busy, `{"max": 20}`)))
+	if err == nil {
+		t.Errorf("reload to a busy address succeeded")
+	}
+	if srv.Route("a") != rp || len(applied.Routes) != 1 || applied.Routes[0].Listen != cur.Routes[0].Listen {
+		t.Errorf("old route a not kept")
+	}
+
+	// A changed route on the same address keeps the connections.
+	if _, err := Reload(srv, applied, parseRoutes(t, route(addr, `{"max": 20}`))); err != nil {
+		t.Fatalf("reload error: %v", err)
+	}
+	if srv.Route("a") == rp {
+		t.Errorf("changed route a was not replaced")
+	}
+	if err := echoByte(); err != nil {
+		t.Errorf("read through the old route a: %v", err)
+	}
+	if c, err := net.Dial("tcp", addr); err != nil {
+		t.Errorf("dial changed route a: %v", err)
+	} else {
+		c.Close()
+	}
+}
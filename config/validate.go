@@ -0,0 +1,470 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ccding/go-rproxy/rproxy"
+)
+
+// validate checks the settings of a parsed configuration.
+func (c *Config) validate(p *parser) error {
+	if c.ShutdownTimeout < 0 {
+		return p.errorf("shutdown_timeout", "must not be negative")
+	}
+	if err := validateConnLimit(p, "max_conns", c.MaxConns); err != nil {
+		return err
+	}
+	if len(c.Routes) == 0 {
+		return p.errorf("routes", "at least one route is required")
+	}
+	names := make(map[string]bool)
+	listens := make(map[string]bool)
+	for i := range c.Routes {
+		r := &c.Routes[i]
+		path := fmt.Sprintf("routes[%d]", i)
+		if r.Name == "" {
+			return p.errorf(path+".name", "route name is required")
+		}
+		if names[r.Name] {
+			return p.errorf(path+".name", "duplicate route name %q", r.Name)
+		}
+		names[r.Name] = true
+		if err := r.validate(p, path); err != nil {
+			return err
+		}
+		if listens[r.Listen] {
+			return p.errorf(path+".listen", "duplicate listen address %q", r.Listen)
+		}
+		listens[r.Listen] = true
+	}
+	return nil
+}
+
+func (r *Route) validate(p *parser, path string) error {
+	// Check the listener
+	proto, _, ok := splitAddr(r.Listen)
+	if !ok {
+		return p.errorf(path+".listen", "expected proto://addr, got %q", r.Listen)
+	}
+	switch proto {
+	case "tcp", "sni", "udp", "unix":
+		if r.TLS != nil {
+			return p.errorf(path+".tls", "only allowed for tls listeners")
+		}
+	case "tls":
+		if r.TLS == nil {
+			return p.errorf(path+".tls", "required for tls listeners")
+		}
+		if err := requireFiles(p, path+".tls", map[string]string{
+			"root_cert": r.TLS.RootCert,
+			"cert":      r.TLS.Cert,
+			"key":       r.TLS.Key,
+		}); err != nil {
+			return err
+		}
+		if r.TLS.ReloadInterval < 0 {
+			return p.errorf(path+".tls.reload_interval", "must not be negative")
+		}
+	default:
+		return p.errorf(path+".listen", "listen protocol %q not supported", proto)
+	}
+	// Check the backends
+	if len(r.Backends) == 0 {
+		return p.errorf(path+".backends", "at least one backend is required")
+	}
+	needTLS, err := validateBackends(p, path, r.Backends, r.Balancer, proto)
+	if err != nil {
+		return err
+	}
+	if needTLS && proto == "sni" {
+		return p.errorf(path+".backends", "TLS passthrough requires tcp backends")
+	}
+	if r.ProxyProtocol < 0 || r.ProxyProtocol > 2 {
+		return p.errorf(path+".proxy_protocol", "expected version 1 or 2, got %d", r.ProxyProtocol)
+	}
+	for j, cidr := range r.AcceptProxyProtocol {
+		if _, err := rproxy.ParseCIDRs([]string{cidr}); err != nil {
+			return p.errorf(fmt.Sprintf("%s.accept_proxy_protocol[%d]", path, j), "%v", err)
+		}
+	}
+	if err := r.validateUDP(p, path, proto); err != nil {
+		return err
+	}
+	if err := r.validateUnix(p, path, proto); err != nil {
+		return err
+	}
+	if s := r.Socket; s != nil {
+		if proto != "unix" {
+			return p.errorf(path+".socket", "only allowed for unix listeners")
+		}
+		if _, err := s.mode(); err != nil {
+			return p.errorf(path+".socket.mode", "expected octal permissions such as 0660, got %q", s.Mode)
+		}
+	}
+	if r.Timeouts.Handshake < 0 {
+		return p.errorf(path+".timeouts.handshake", "must not be negative")
+	}
+	if r.Timeouts.Idle < 0 {
+		return p.errorf(path+".timeouts.idle", "must not be negative")
+	}
+	if r.Timeouts.MaxLifetime < 0 {
+		return p.errorf(path+".timeouts.max_lifetime", "must not be negative")
+	}
+	if r.Timeouts.Dial < 0 {
+		return p.errorf(path+".timeouts.dial", "must not be negative")
+	}
+	if r.Timeouts.BackendHandshake < 0 {
+		return p.errorf(path+".timeouts.backend_handshake", "must not be negative")
+	}
+	if rt := r.Retry; rt != nil {
+		if rt.Retries < 0 || rt.Retries > rproxy.MaxRetries {
+			return p.errorf(path+".retry.retries", "must be from 0 to %d", rproxy.MaxRetries)
+		}
+		if rt.Backoff < 0 {
+			return p.errorf(path+".retry.backoff", "must not be negative")
+		}
+		if rt.MaxBackoff < 0 {
+			return p.errorf(path+".retry.max_backoff", "must not be negative")
+		}
+		if rt.Jitter < 0 || rt.Jitter > 1 {
+			return p.errorf(path+".retry.jitter", "must be from 0 to 1")
+		}
+	}
+	// Check the health check
+	if hc := r.HealthCheck; hc != nil {
+		hpath := path + ".health_check"
+		switch hc.Mode {
+		case "", rproxy.HealthCheckTCP:
+		case rproxy.HealthCheckTLS:
+			needTLS = true
+		case rproxy.HealthCheckPayload:
+			if hc.Expect == "" {
+				return p.errorf(hpath+".expect", "required for payload health checks")
+			}
+		default:
+			return p.errorf(hpath+".mode", "health check mode %q not supported", hc.Mode)
+		}
+		if hc.Interval < 0 {
+			return p.errorf(hpath+".interval", "must not be negative")
+		}
+		if hc.Timeout < 0 {
+			return p.errorf(hpath+".timeout", "must not be negative")
+		}
+	}
+	if err := validateBackendTLS(p, path, r.BackendTLS, needTLS); err != nil {
+		return err
+	}
+	if err := validateCertPolicy(p, path, r.ClientAuth, proto); err != nil {
+		return err
+	}
+	if err := validateConnLimit(p, path+".max_conns", r.MaxConns); err != nil {
+		return err
+	}
+	if err := validateConnLimit(p, path+".backend_max_conns", r.BackendMaxConns); err != nil {
+		return err
+	}
+	if bl := r.Bandwidth; bl != nil {
+		for _, scope := range []struct {
+			name string
+			bw   Bandwidth
+		}{{"conn", bl.Conn}, {"client", bl.Client}, {"route", bl.Route}} {
+			bpath := path + ".bandwidth." + scope.name
+			if scope.bw.Upload < 0 {
+				return p.errorf(bpath+".upload", "must not be negative")
+			}
+			if scope.bw.Download < 0 {
+				return p.errorf(bpath+".download", "must not be negative")
+			}
+		}
+	}
+	if rl := r.RateLimit; rl != nil {
+		rpath := path + ".rate_limit"
+		if rl.Rate <= 0 {
+			return p.errorf(rpath+".rate", "must be positive")
+		}
+		if rl.Burst < 1 {
+			return p.errorf(rpath+".burst", "must be at least 1")
+		}
+		switch rl.Key {
+		case "", rproxy.RateLimitGlobal, rproxy.RateLimitIP:
+		case rproxy.RateLimitCert:
+			if proto != "tls" {
+				return p.errorf(rpath+".key", "cert is only allowed for tls listeners")
+			}
+		default:
+			return p.errorf(rpath+".key", "rate limit key %q not supported", rl.Key)
+		}
+		switch rl.Policy {
+		case "", rproxy.RateLimitReject, rproxy.RateLimitDelay:
+		default:
+			return p.errorf(rpath+".policy", "rate limit policy %q not supported", rl.Policy)
+		}
+		if rl.MaxDelay < 0 {
+			return p.errorf(rpath+".max_delay", "must not be negative")
+		}
+	}
+	if f := r.IPFilter; f != nil {
+		for _, kind := range []string{"allow", "deny"} {
+			cidrs := f.Allow
+			if kind == "deny" {
+				cidrs = f.Deny
+			}
+			for j, cidr := range cidrs {
+				if _, err := rproxy.ParseCIDRs([]string{cidr}); err != nil {
+					return p.errorf(fmt.Sprintf("%s.ip_filter.%s[%d]", path, kind, j), "%v", err)
+				}
+			}
+		}
+	}
+	// Check the SNI routes
+	if len(r.SNI) > 0 && (proto == "tcp" || proto == "udp" || proto == "unix") {
+		return p.errorf(path+".sni", "only allowed for tls and sni listeners")
+	}
+	serverNames := make(map[string]bool)
+	for j := range r.SNI {
+		sr := &r.SNI[j]
+		spath := fmt.Sprintf("%s.sni[%d]", path, j)
+		name := strings.ToLower(sr.ServerName)
+		if name == "" || strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+			return p.errorf(spath+".server_name", "expected a name such as www.example.com or *.example.com, got %q", sr.ServerName)
+		}
+		if serverNames[name] {
+			return p.errorf(spath+".server_name", "duplicate server name %q", sr.ServerName)
+		}
+		serverNames[name] = true
+		needTLS, err := validateBackends(p, spath, sr.Backends, sr.Balancer, proto)
+		if err != nil {
+			return err
+		}
+		if needTLS && proto == "sni" {
+			return p.errorf(spath+".backends", "TLS passthrough requires tcp backends")
+		}
+		if sr.BackendTLS != nil || needTLS {
+			if err := validateBackendTLS(p, spath, sr.BackendTLS, needTLS); err != nil {
+				return err
+			}
+		}
+		if err := validateCertPolicy(p, spath, sr.ClientAuth, proto); err != nil {
+			return err
+		}
+		if c := sr.Certificate; c != nil {
+			if proto == "sni" {
+				return p.errorf(spath+".certificate", "TLS passthrough cannot serve certificates")
+			}
+			if c.Cert == "" {
+				return p.errorf(spath+".certificate.cert", "file name is required")
+			}
+			if c.Key == "" {
+				return p.errorf(spath+".certificate.key", "file name is required")
+			}
+			if c.ReloadInterval < 0 {
+				return p.errorf(spath+".certificate.reload_interval", "must not be negative")
+			}
+		}
+	}
+	// Check the ALPN routes
+	if len(r.ALPN) > 0 && proto != "tls" {
+		return p.errorf(path+".alpn", "only allowed for tls listeners")
+	}
+	if len(r.ALPNRoutes) > 0 && (proto == "tcp" || proto == "udp" || proto == "unix") {
+		return p.errorf(path+".alpn_routes", "only allowed for tls and sni listeners")
+	}
+	protocols := make(map[string]bool)
+	for j := range r.ALPNRoutes {
+		ar := &r.ALPNRoutes[j]
+		apath := fmt.Sprintf("%s.alpn_routes[%d]", path, j)
+		if ar.Protocol == "" {
+			return p.errorf(apath+".protocol", "protocol is required")
+		}
+		if protocols[ar.Protocol] {
+			return p.errorf(apath+".protocol", "duplicate protocol %q", ar.Protocol)
+		}
+		protocols[ar.Protocol] = true
+		if len(ar.Backends) == 0 {
+			return p.errorf(apath+".backends", "at least one backend is required")
+		}
+		needTLS, err := validateBackends(p, apath, ar.Backends, ar.Balancer, proto)
+		if err != nil {
+			return err
+		}
+		if needTLS && proto == "sni" {
+			return p.errorf(apath+".backends", "TLS passthrough requires tcp backends")
+		}
+		if err := validateBackendTLS(p, apath, ar.BackendTLS, needTLS); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateBackends checks the backends and balancer under path, and reports
+// whether any backend needs TLS.
+func validateBackends(p *parser, path string, backends []string, balancer, listenProto string) (bool, error) {
+	needTLS := false
+	for j, b := range backends {
+		bpath := fmt.Sprintf("%s.backends[%d]", path, j)
+		proto, _, ok := splitAddr(b)
+		if !ok {
+			return false, p.errorf(bpath, "expected proto://addr, got %q", b)
+		}
+		if (proto == "udp") != (listenProto == "udp") {
+			return false, p.errorf(bpath, "udp listeners and backends go together")
+		}
+		switch proto {
+		case "tcp", "udp", "unix":
+		case "tls":
+			needTLS = true
+		default:
+			return false, p.errorf(bpath, "backend protocol %q not supported", proto)
+		}
+	}
+	if _, err := rproxy.NewBalancer(balancer); err != nil {
+		return false, p.errorf(path+".balancer", "%v", err)
+	}
+	return needTLS, nil
+}
+
+// validateUDP checks the settings depending on whether the listen protocol is
+// udp, which forwards datagrams without the features of streams.
+func (r *Route) validateUDP(p *parser, path, proto string) error {
+	if proto != "udp" {
+		if r.DatagramSize != 0 {
+			return p.errorf(path+".datagram_size", "only allowed for udp listeners")
+		}
+		if r.MaxSessions != 0 {
+			return p.errorf(path+".max_sessions", "only allowed for udp listeners")
+		}
+		return nil
+	}
+	if r.DatagramSize < 0 {
+		return p.errorf(path+".datagram_size", "must not be negative")
+	}
+	if r.MaxSessions < 0 {
+		return p.errorf(path+".max_sessions", "must not be negative")
+	}
+	for _, setting := range []struct {
+		name string
+		set  bool
+	}{
+		{"proxy_protocol", r.ProxyProtocol != 0},
+		{"accept_proxy_protocol", len(r.AcceptProxyProtocol) > 0},
+		{"health_check", r.HealthCheck != nil},
+		{"rate_limit", r.RateLimit != nil},
+		{"max_conns", r.MaxConns != nil},
+		{"backend_max_conns", r.BackendMaxConns != nil},
+		{"bandwidth", r.Bandwidth != nil},
+	} {
+		if setting.set {
+			return p.errorf(path+"."+setting.name, "not supported for udp listeners")
+		}
+	}
+	return nil
+}
+
+// validateUnix checks the settings depending on whether the listen protocol
+// is unix, whose clients have no IP address.
+func (r *Route) validateUnix(p *parser, path, proto string) error {
+	if proto != "unix" {
+		return nil
+	}
+	if len(r.AcceptProxyProtocol) > 0 {
+		return p.errorf(path+".accept_proxy_protocol", "not supported for unix listeners")
+	}
+	if r.IPFilter != nil {
+		return p.errorf(path+".ip_filter", "not supported for unix listeners")
+	}
+	if rl := r.RateLimit; rl != nil && (rl.Key == "" || rl.Key == rproxy.RateLimitIP) {
+		return p.errorf(path+".rate_limit.key", "ip is not supported for unix listeners")
+	}
+	return nil
+}
+
+// validateBackendTLS checks the backend TLS material under path, which is
+// required if needTLS and not allowed otherwise.
+func validateBackendTLS(p *parser, path string, t *ClientTLS, needTLS bool) error {
+	if !needTLS {
+		if t != nil {
+			return p.errorf(path+".backend_tls", "only allowed with tls backends or health checks")
+		}
+		return nil
+	}
+	if t == nil {
+		return p.errorf(path+".backend_tls", "required for tls backends and health checks")
+	}
+	if t.ReloadInterval < 0 {
+		return p.errorf(path+".backend_tls.reload_interval", "must not be negative")
+	}
+	return requireFiles(p, path+".backend_tls", map[string]string{
+		"root_cert": t.RootCert,
+		"cert":      t.Cert,
+		"key":       t.Key,
+	})
+}
+
+// validateCertPolicy checks the client_auth policy under path, which is only
+// allowed for tls listeners.
+func validateCertPolicy(p *parser, path string, cp *CertPolicy, proto string) error {
+	if cp == nil {
+		return nil
+	}
+	if proto != "tls" {
+		return p.errorf(path+".client_auth", "only allowed for tls listeners")
+	}
+	for _, kind := range []string{"allow", "deny"} {
+		rules := cp.Allow
+		if kind == "deny" {
+			rules = cp.Deny
+		}
+		for j, r := range rules {
+			policy := &rproxy.CertPolicy{Allow: []rproxy.CertRule{rproxy.CertRule(r)}}
+			if err := policy.Validate(); err != nil {
+				return p.errorf(fmt.Sprintf("%s.client_auth.%s[%d]", path, kind, j), "%v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateConnLimit checks the connection limit under path.
+func validateConnLimit(p *parser, path string, l *ConnLimit) error {
+	if l == nil {
+		return nil
+	}
+	if l.Max < 1 {
+		return p.errorf(path+".max", "must be at least 1")
+	}
+	if l.Queue < 0 {
+		return p.errorf(path+".queue", "must not be negative")
+	}
+	if l.Queue > 0 && l.QueueTimeout <= 0 {
+		return p.errorf(path+".queue_timeout", "must be positive with a queue")
+	}
+	return nil
+}
+
+// requireFiles checks that the file names under path are all set.
+func requireFiles(p *parser, path string, files map[string]string) error {
+	for _, field := range []string{"root_cert", "cert", "key"} {
+		if files[field] == "" {
+			return p.errorf(path+"."+field, "file name is required")
+		}
+	}
+	return nil
+}
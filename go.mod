@@ -0,0 +1,3 @@
+module github.com/ccding/go-rproxy
+
+go 1.19
@@ -0,0 +1,78 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+// Package backendtest starts backend servers for the tests of the proxy.
+package backendtest
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// Listen listens on network and address, failing t on error.
+func Listen(t testing.TB, network, address string) net.Listener {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	return ln
+}
+
+// Start starts a backend accepting connections on ln, or on a new local TCP
+// listener if ln is nil, and serving each of them with serve. The listener is
+// closed when the test ends. It returns the address of the backend.
+func Start(t testing.TB, ln net.Listener, serve func(conn net.Conn)) string {
+	if ln == nil {
+		ln = Listen(t, "tcp", "127.0.0.1:0")
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+// Echo writes back what it reads from conn, then closes it.
+func Echo(conn net.Conn) {
+	io.Copy(conn, conn)
+	conn.Close()
+}
+
+// Banner returns a serve function writing banner to conn, then closing it.
+func Banner(banner string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		conn.Write([]byte(banner))
+		conn.Close()
+	}
+}
+
+// Named returns a serve function writing name to conn, then keeping it open
+// until the client closes it, so that the backend serving a connection can be
+// told.
+func Named(name string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		conn.Write([]byte(name))
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}
+}
@@ -17,38 +17,167 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/ccding/go-rproxy/certs"
+	"github.com/ccding/go-rproxy/config"
 	"github.com/ccding/go-rproxy/rproxy"
 )
 
+var (
+	configFile       = flag.String("config", "", "configuration file, which overrides the other flags")
+	listen           = flag.String("l", "tls://:23001", "listen address, whose protocol is tcp, tls, sni (TLS passthrough), udp, or unix")
+	backend          = flag.String("b", "tls://127.0.0.1:23002", "backend addresses, such as tcp://127.0.0.1:80 or unix:///run/app.sock, separated by commas")
+	balancer         = flag.String("lb", "roundrobin", "load balancer: roundrobin, leastconn, random2, sourcehash, or failover")
+	healthCheck      = flag.String("hc", "", "backend health check: tcp, tls, or payload (disabled if empty)")
+	healthInterval   = flag.Duration("hci", rproxy.DefaultHealthCheckInterval, "backend health check interval")
+	healthSend       = flag.String("hcsend", "", "data sent by the payload health check")
+	healthExpect     = flag.String("hcexpect", "", "response expected by the payload health check")
+	rootCert         = flag.String("rcert", "certs/root_cert.pem", "root cert")
+	serverCert       = flag.String("scert", "certs/server_cert.pem", "server cert")
+	serverKey        = flag.String("skey", "certs/server_key.pem", "server key")
+	clientCert       = flag.String("ccert", "certs/client_0_cert.pem", "client cert")
+	clientKey        = flag.String("ckey", "certs/client_0_key.pem", "client key")
+	serverName       = flag.String("sname", "testapp-server", "server name")
+	nextProtos       = flag.String("alpn", "", "ALPN protocols offered by the tls listener, separated by commas")
+	proxyProtocol    = flag.Int("pp", 0, "PROXY protocol version, 1 or 2, sent to the backends (disabled if 0)")
+	acceptProxy      = flag.String("acceptpp", "", "networks of trusted load balancers sending PROXY protocol headers, separated by commas")
+	allowIPs         = flag.String("allow", "", "networks of the clients allowed, separated by commas (all if empty)")
+	denyIPs          = flag.String("deny", "", "networks of the clients denied, separated by commas")
+	rateLimit        = flag.Float64("rl", 0, "new connections per second allowed per client IP (unlimited if 0)")
+	rateBurst        = flag.Int("rlburst", 10, "new connections allowed at once per client IP")
+	rateDelay        = flag.Duration("rldelay", 0, "longest delay of the connections over the rate limit (rejected at once if 0)")
+	maxConns         = flag.Int("maxconns", 0, "maximum concurrent client connections (unlimited if 0)")
+	backendMaxConns  = flag.Int("bmaxconns", 0, "maximum concurrent connections per backend (unlimited if 0)")
+	connQueue        = flag.Int("queue", 0, "connections waiting over -maxconns or -bmaxconns (rejected at once if 0)")
+	queueTimeout     = flag.Duration("qtimeout", 10*time.Second, "longest wait in the -queue")
+	uploadRate       = flag.Int64("up", 0, "upload rate of each connection in bytes per second (unlimited if 0)")
+	downloadRate     = flag.Int64("down", 0, "download rate of each connection in bytes per second (unlimited if 0)")
+	certReload       = flag.Duration("creload", 0, "interval to check certificate files for changes (disabled if zero)")
+	verbose          = flag.Bool("v", false, "verbose mode")
+	handshakeTimeout = flag.Duration("hto", rproxy.DefaultHandshakeTimeout, "client TLS handshake timeout")
+	idleTimeout      = flag.Duration("idle", 0, "close connections with no data in either direction for this long (disabled if zero)")
+	maxLifetime      = flag.Duration("lifetime", 0, "close connections open for this long (disabled if zero)")
+	dialTimeout      = flag.Duration("dto", rproxy.DefaultDialTimeout, "backend connect timeout")
+	backendHandshake = flag.Duration("bhto", rproxy.DefaultHandshakeTimeout, "backend TLS handshake timeout")
+	dialRetries      = flag.Int("retries", 0, "backend dials retried before giving up on the client")
+	dialBackoff      = flag.Duration("backoff", 100*time.Millisecond, "wait before the first retry, doubled for each next one up to 10 times")
+	socketMode       = flag.String("sockmode", "", "permissions of the unix listener socket, such as 0660")
+	socketOwner      = flag.String("sockowner", "", "owner user of the unix listener socket")
+	socketGroup      = flag.String("sockgroup", "", "owner group of the unix listener socket")
+	datagramSize     = flag.Int("dgram", rproxy.DefaultDatagramSize, "largest UDP datagram proxied")
+	udpSessions      = flag.Int("udpsessions", rproxy.DefaultMaxUDPSessions, "most UDP sessions open at once")
+	grace            = flag.Duration("grace", 30*time.Second, "time to let connections finish on shutdown")
+)
+
 func main() {
-	var listen = flag.String("l", "tls://:23001", "listen address")
-	var backend = flag.String("b", "tls://127.0.0.1:23002", "backend address")
-	var rootCert = flag.String("rcert", "certs/root_cert.pem", "root cert")
-	var serverCert = flag.String("scert", "certs/server_cert.pem", "server cert")
-	var serverKey = flag.String("skey", "certs/server_key.pem", "server key")
-	var clientCert = flag.String("ccert", "certs/client_0_cert.pem", "client cert")
-	var clientKey = flag.String("ckey", "certs/client_0_key.pem", "client key")
-	var serverName = flag.String("sname", "testapp-server", "server name")
-	var verbose = flag.Bool("v", false, "verbose mode")
 	flag.Parse()
 
-	listenProtoAndAddr := strings.Split(*listen, "://")
-	backendProtoAndAddr := strings.Split(*backend, "://")
+	var srv *rproxy.Server
+	var conf *config.Config
+	if *configFile != "" {
+		var err error
+		conf, err = config.Load(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if srv, err = conf.NewServer(); err != nil {
+			log.Fatal(err)
+		}
+		for _, r := range conf.Routes {
+			log.Printf("Listening on: %s", r.Listen)
+			log.Printf("Forwarding to: %s", strings.Join(r.Backends, ","))
+		}
+		*grace = conf.Grace()
+	} else {
+		srv = newServer()
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Start()
+	}()
 
-	if len(listenProtoAndAddr) != 2 || len(backendProtoAndAddr) != 2 {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case err := <-errc:
+			log.Fatal(err)
+		case sig := <-sigc:
+			if sig == syscall.SIGHUP {
+				conf = reload(srv, conf)
+				continue
+			}
+			log.Printf("Received %v, shutting down", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), *grace)
+			defer cancel()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Shutdown: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// reload re-reads the configuration file and applies it to srv, which is
+// running conf. It returns the configuration srv runs afterwards.
+func reload(srv *rproxy.Server, conf *config.Config) *config.Config {
+	logger := srv.Logger()
+	if conf == nil {
+		logger.Printf("Reload: no configuration file")
+		return nil
+	}
+	next, err := config.Load(*configFile)
+	if err != nil {
+		logger.Printf("Reload: %v, keeping the running configuration", err)
+		return conf
+	}
+	conf, err = config.Reload(srv, conf, next)
+	*grace = conf.Grace()
+	if err != nil {
+		logger.Printf("%v", err)
+		return conf
+	}
+	logger.Printf("Reloaded %s", *configFile)
+	return conf
+}
+
+// newServer creates the server of a single route from the flags.
+func newServer() *rproxy.Server {
+	// Split at the first ://, as unix socket paths may contain it
+	listenProtoAndAddr := strings.SplitN(*listen, "://", 2)
+	var backendProtoAndAddrs [][]string
+	for _, b := range strings.Split(*backend, ",") {
+		backendProtoAndAddrs = append(backendProtoAndAddrs, strings.SplitN(b, "://", 2))
+	}
+
+	if len(listenProtoAndAddr) != 2 {
 		panic("Wrong arguments.")
 	}
+	for _, backendProtoAndAddr := range backendProtoAndAddrs {
+		if len(backendProtoAndAddr) != 2 {
+			panic("Wrong arguments.")
+		}
+	}
+	lb, err := rproxy.NewBalancer(*balancer)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	rp := rproxy.NewRProxy(
 		listenProtoAndAddr[0],
 		listenProtoAndAddr[1],
-		backendProtoAndAddr[0],
-		backendProtoAndAddr[1],
+		backendProtoAndAddrs[0][0],
+		backendProtoAndAddrs[0][1],
 		*rootCert,
 		*serverCert,
 		*serverKey,
@@ -56,11 +185,123 @@ func main() {
 		*clientKey,
 		*serverName,
 	)
+	for _, backendProtoAndAddr := range backendProtoAndAddrs[1:] {
+		rp.AddBackend(backendProtoAndAddr[0], backendProtoAndAddr[1])
+	}
+	rp.SetBalancer(lb)
+	if *healthCheck != "" {
+		rp.SetHealthCheck(&rproxy.HealthCheck{
+			Mode:     *healthCheck,
+			Interval: *healthInterval,
+			Send:     []byte(*healthSend),
+			Expect:   []byte(*healthExpect),
+		})
+	}
+	if *certReload > 0 {
+		if strings.ToLower(listenProtoAndAddr[0]) == "tls" {
+			config, err := certs.LoadReloadingServerCerts(*rootCert, *serverCert, *serverKey, *certReload)
+			if err != nil {
+				log.Fatal(err)
+			}
+			rp.SetServerConfig(config)
+		}
+		for _, backendProtoAndAddr := range backendProtoAndAddrs {
+			if strings.ToLower(backendProtoAndAddr[0]) == "tls" {
+				config, err := certs.LoadReloadingClientCerts(*rootCert, *clientCert, *clientKey, *serverName, *certReload)
+				if err != nil {
+					log.Fatal(err)
+				}
+				rp.SetClientConfig(config)
+				break
+			}
+		}
+	}
+	if *nextProtos != "" {
+		rp.SetNextProtos(strings.Split(*nextProtos, ","))
+	}
+	rp.SetProxyProtocol(*proxyProtocol)
+	if *maxConns > 0 {
+		rp.SetConnLimit(rproxy.NewLimiter(*maxConns, *connQueue, *queueTimeout))
+	}
+	if *backendMaxConns > 0 {
+		for _, b := range rp.Backends() {
+			b.SetConnLimit(rproxy.NewLimiter(*backendMaxConns, *connQueue, *queueTimeout))
+		}
+	}
+	if *uploadRate > 0 || *downloadRate > 0 {
+		rp.SetBandwidthLimit(&rproxy.BandwidthLimit{
+			Conn: rproxy.Bandwidth{Upload: *uploadRate, Download: *downloadRate},
+		})
+	}
+	if *rateLimit > 0 {
+		policy := rproxy.RateLimitReject
+		if *rateDelay > 0 {
+			policy = rproxy.RateLimitDelay
+		}
+		rp.SetRateLimit(&rproxy.RateLimit{
+			Rate:     *rateLimit,
+			Burst:    *rateBurst,
+			Key:      rproxy.RateLimitIP,
+			Policy:   policy,
+			MaxDelay: *rateDelay,
+		})
+	}
+	if *allowIPs != "" || *denyIPs != "" {
+		f := &rproxy.IPFilter{}
+		if *allowIPs != "" {
+			if f.Allow, err = rproxy.ParseCIDRs(strings.Split(*allowIPs, ",")); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *denyIPs != "" {
+			if f.Deny, err = rproxy.ParseCIDRs(strings.Split(*denyIPs, ",")); err != nil {
+				log.Fatal(err)
+			}
+		}
+		rp.SetIPFilter(f)
+	}
+	if *acceptProxy != "" {
+		trusted, err := rproxy.ParseCIDRs(strings.Split(*acceptProxy, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		rp.SetAcceptProxyProtocol(trusted)
+	}
 	rp.SetVerbose(*verbose)
+	rp.SetHandshakeTimeout(*handshakeTimeout)
+	rp.SetIdleTimeout(*idleTimeout)
+	rp.SetMaxLifetime(*maxLifetime)
+	rp.SetDialTimeout(*dialTimeout)
+	rp.SetBackendHandshakeTimeout(*backendHandshake)
+	rp.SetDatagramSize(*datagramSize)
+	rp.SetMaxUDPSessions(*udpSessions)
+	if *socketMode != "" || *socketOwner != "" || *socketGroup != "" {
+		var mode uint64
+		if *socketMode != "" {
+			if mode, err = strconv.ParseUint(*socketMode, 8, 32); err != nil {
+				log.Fatal(err)
+			}
+		}
+		rp.SetUnixSocket(&rproxy.UnixSocket{
+			Mode:  os.FileMode(mode),
+			Owner: *socketOwner,
+			Group: *socketGroup,
+		})
+	}
+	if *dialRetries > 0 {
+		rp.SetRetryPolicy(&rproxy.RetryPolicy{
+			Retries:    *dialRetries,
+			Backoff:    *dialBackoff,
+			MaxBackoff: *dialBackoff << 10,
+			Jitter:     0.2,
+		})
+	}
 
-	go log.Fatal(rp.Start())
-	time.Sleep(time.Millisecond)
+	srv := rproxy.NewServer()
+	if err := srv.Add(*listen, rp); err != nil {
+		log.Fatal(err)
+	}
 	log.Printf("Listening on: %s", *listen)
 	log.Printf("Forwarding to: %s", *backend)
-	select {}
+	return srv
 }
@@ -0,0 +1,87 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// alpnRoute routes the connections negotiating an application protocol.
+type alpnRoute struct {
+	protocol string
+	pool     *Pool
+}
+
+// SetNextProtos sets the application protocols offered by the TLS listener
+// through ALPN, in order of preference. If not set, the protocols of the ALPN
+// routes are offered.
+func (rp *RProxy) SetNextProtos(protos []string) {
+	rp.nextProtos = protos
+}
+
+// AddALPNRoute routes the connections negotiating protocol, such as h2 or
+// http/1.1, to the backends in pool. SNI routes with backends take precedence
+// over ALPN routes. With the sni listen protocol, where nothing is negotiated
+// by the proxy, the first protocol offered by the client with a route is used.
+// It must be called before Start.
+func (rp *RProxy) AddALPNRoute(protocol string, pool *Pool) {
+	rp.alpnRoutes = append(rp.alpnRoutes, alpnRoute{protocol: protocol, pool: pool})
+}
+
+// matchALPN returns the pool for the first of protos with a route, or nil if
+// there is none.
+func (rp *RProxy) matchALPN(protos []string) *Pool {
+	for _, proto := range protos {
+		for _, route := range rp.alpnRoutes {
+			if route.protocol == proto {
+				return route.pool
+			}
+		}
+	}
+	return nil
+}
+
+// alpnServerConfig returns a copy of config offering the ALPN protocols.
+func (rp *RProxy) alpnServerConfig(config *tls.Config) *tls.Config {
+	protos := rp.nextProtos
+	if len(protos) == 0 {
+		for _, route := range rp.alpnRoutes {
+			protos = append(protos, route.protocol)
+		}
+	}
+	config = config.Clone()
+	config.NextProtos = protos
+	return config
+}
+
+// negotiatedProtocol returns the application protocol negotiated by a client
+// connection, or an empty string if there is none.
+func negotiatedProtocol(conn net.Conn) string {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		return tlsConn.ConnectionState().NegotiatedProtocol
+	}
+	return ""
+}
+
+// withNextProto returns a copy of config offering only proto to the backend,
+// so that the backend speaks the protocol the client negotiated.
+func withNextProto(config *tls.Config, proto string) *tls.Config {
+	config = config.Clone()
+	config.NextProtos = []string{proto}
+	return config
+}
@@ -0,0 +1,66 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"testing"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+func TestALPNRoute(t *testing.T) {
+	pki := newTestPKI(t)
+	backend := pki.serverConfig("backend.test")
+	backend.NextProtos = []string{"h2", "http/1.1"}
+	rp := NewRProxyWithoutCerts("tls", "127.0.0.1:0", "tls", backendtest.Start(t, tlsListener(t, backend), writeProtocol))
+	rp.SetServerConfig(pki.serverConfig("proxy.test"))
+	rp.SetClientConfig(pki.clientConfig("proxy", "backend.test"))
+	rp.SetNextProtos([]string{"h2", "http/1.1", "custom"})
+	rp.AddALPNRoute("custom", NewPool(nil, NewBackend("tcp", backendtest.Start(t, nil, backendtest.Banner("custom")))))
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	tests := []struct {
+		protos     []string
+		negotiated string
+		want       string
+	}{
+		{[]string{"h2", "http/1.1"}, "h2", "backend:h2"},
+		{[]string{"http/1.1"}, "http/1.1", "backend:http/1.1"},
+		{[]string{"custom"}, "custom", "custom"},
+		{nil, "", "backend:"},
+	}
+	for _, tt := range tests {
+		config := pki.clientConfig("testapp-client-0", "proxy.test")
+		config.NextProtos = tt.protos
+		conn, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			t.Errorf("%v: dial error: %v", tt.protos, err)
+			continue
+		}
+		if got := conn.ConnectionState().NegotiatedProtocol; got != tt.negotiated {
+			t.Errorf("%v: negotiated %q, want %q", tt.protos, got, tt.negotiated)
+		}
+		got, err := io.ReadAll(conn)
+		conn.Close()
+		if string(got) != tt.want {
+			t.Errorf("%v: got %q, %v, want %q", tt.protos, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNoBackend is returned when a pool has no backend to forward to.
+var ErrNoBackend = errors.New("rproxy: no backend available")
+
+// Backend is a backend server the proxy forwards connections to.
+type Backend struct {
+	Proto  string // backend protocol: tcp, tls, udp, or unix
+	Addr   string // backend address
+	active int64  // number of connections being proxied
+	limit  *Limiter
+
+	mu     sync.Mutex
+	down   bool // failed the last health check
+	fenced bool // failed over from, see NewFailoverBalancer
+	conns  map[net.Conn]struct{}
+}
+
+// NewBackend creates a Backend from its protocol and address.
+func NewBackend(proto, addr string) *Backend {
+	return &Backend{
+		Proto: strings.ToLower(proto),
+		Addr:  normalizeAddr(proto, addr),
+	}
+}
+
+// String returns the backend in the form of proto://addr.
+func (b *Backend) String() string {
+	return b.Proto + "://" + b.Addr
+}
+
+// ActiveConns returns the number of connections being proxied to the backend.
+func (b *Backend) ActiveConns() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+// SetConnLimit limits the number of concurrent connections to the backend.
+// Balancing skips the backends at their limit while others have room. It
+// must be called before Start.
+func (b *Backend) SetConnLimit(l *Limiter) {
+	b.limit = l
+}
+
+// ConnLimit returns the limiter set by SetConnLimit.
+func (b *Backend) ConnLimit() *Limiter {
+	return b.limit
+}
+
+func (b *Backend) acquire() {
+	atomic.AddInt64(&b.active, 1)
+}
+
+func (b *Backend) release() {
+	atomic.AddInt64(&b.active, -1)
+}
+
+// Pool is a group of backends sharing a load-balancing strategy.
+type Pool struct {
+	mu           sync.RWMutex
+	backends     []*Backend
+	balancer     Balancer
+	clientConfig *tls.Config
+}
+
+// NewPool creates a Pool of backends. If balancer is nil, round-robin is used.
+func NewPool(balancer Balancer, backends ...*Backend) *Pool {
+	if balancer == nil {
+		balancer = NewRoundRobinBalancer()
+	}
+	return &Pool{backends: backends, balancer: balancer}
+}
+
+// Add adds a backend to the pool.
+func (p *Pool) Add(b *Backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Copy on write, as Pick hands out the slice without holding the lock
+	backends := make([]*Backend, len(p.backends), len(p.backends)+1)
+	copy(backends, p.backends)
+	p.backends = append(backends, b)
+}
+
+// SetBalancer sets the load-balancing strategy of the pool.
+func (p *Pool) SetBalancer(balancer Balancer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.balancer = balancer
+}
+
+// SetClientConfig sets the config for dialing the TLS backends of the pool.
+// If not set, the client config of the proxy is used.
+func (p *Pool) SetClientConfig(config *tls.Config) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clientConfig = config
+}
+
+// ClientConfig returns the config set by SetClientConfig.
+func (p *Pool) ClientConfig() *tls.Config {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.clientConfig
+}
+
+// Backends returns the backends in the pool.
+func (p *Pool) Backends() []*Backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.backends
+}
+
+// Pick chooses the backend for a new connection from client among the
+// healthy backends.
+func (p *Pool) Pick(client net.Addr) (*Backend, error) {
+	p.mu.RLock()
+	all, balancer := p.backends, p.balancer
+	p.mu.RUnlock()
+	backends := make([]*Backend, 0, len(all))
+	for _, b := range all {
+		if b.Healthy() {
+			backends = append(backends, b)
+		}
+	}
+	if len(backends) == 0 {
+		return nil, ErrNoBackend
+	}
+	// Prefer the backends below their connection limit, if any, unless
+	// the order of the backends matters
+	if a, ok := balancer.(allBackendsBalancer); ok && a.wantsAllBackends() {
+		return balancer.Pick(backends, client), nil
+	}
+	available := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		if b.limit == nil || !b.limit.full() {
+			available = append(available, b)
+		}
+	}
+	if len(available) > 0 {
+		backends = available
+	}
+	if b := balancer.Pick(backends, client); b != nil {
+		return b, nil
+	}
+	return nil, ErrNoBackend
+}
+
+// dialFailed tells the balancer of the pool that dialing b failed. It reports
+// whether the balancer fails over to another backend.
+func (p *Pool) dialFailed(b *Backend) bool {
+	p.mu.RLock()
+	balancer := p.balancer
+	p.mu.RUnlock()
+	o, ok := balancer.(DialObserver)
+	if ok {
+		o.DialFailed(b)
+	}
+	return ok
+}
+
+// dialSucceeded tells the balancer of the pool that a connection to b was
+// established.
+func (p *Pool) dialSucceeded(b *Backend) {
+	p.mu.RLock()
+	balancer := p.balancer
+	p.mu.RUnlock()
+	if o, ok := balancer.(DialObserver); ok {
+		o.DialSucceeded(b)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Balancer defines the strategy used to pick a backend for a new connection.
+// Library users may implement their own.
+type Balancer interface {
+	// Pick returns one of backends, which is never empty, for a connection
+	// from client. It may return nil if none of them should be used.
+	Pick(backends []*Backend, client net.Addr) *Backend
+}
+
+// allBackendsBalancer is implemented by the balancers which pick by the
+// order of the backends, and so are given all the healthy backends rather
+// than those below their connection limit.
+type allBackendsBalancer interface {
+	wantsAllBackends() bool
+}
+
+// NewBalancer creates a built-in Balancer by name: roundrobin, leastconn,
+// random2, sourcehash, or failover.
+func NewBalancer(name string) (Balancer, error) {
+	switch strings.ToLower(name) {
+	case "", "roundrobin":
+		return NewRoundRobinBalancer(), nil
+	case "leastconn":
+		return NewLeastConnBalancer(), nil
+	case "random2":
+		return NewRandomTwoBalancer(), nil
+	case "sourcehash":
+		return NewSourceHashBalancer(0), nil
+	case "failover":
+		return NewFailoverBalancer(0), nil
+	default:
+		return nil, fmt.Errorf("unknown balancer %q", name)
+	}
+}
+
+type roundRobin struct {
+	next uint64
+}
+
+// NewRoundRobinBalancer creates a Balancer which picks backends in turn.
+func NewRoundRobinBalancer() Balancer {
+	return &roundRobin{}
+}
+
+// Pick picks the next backend.
+func (rr *roundRobin) Pick(backends []*Backend, client net.Addr) *Backend {
+	n := atomic.AddUint64(&rr.next, 1) - 1
+	return backends[n%uint64(len(backends))]
+}
+
+type leastConn struct{}
+
+// NewLeastConnBalancer creates a Balancer which picks the backend with the
+// fewest active connections.
+func NewLeastConnBalancer() Balancer {
+	return leastConn{}
+}
+
+// Pick picks the backend with the fewest active connections.
+func (leastConn) Pick(backends []*Backend, client net.Addr) *Backend {
+	best := backends[0]
+	for _, b := range backends[1:] {
+		if b.ActiveConns() < best.ActiveConns() {
+			best = b
+		}
+	}
+	return best
+}
+
+type randomTwo struct{}
+
+// NewRandomTwoBalancer creates a Balancer which picks two backends at random
+// and uses the one with fewer active connections.
+func NewRandomTwoBalancer() Balancer {
+	return randomTwo{}
+}
+
+// Pick picks the less loaded of two random backends.
+func (randomTwo) Pick(backends []*Backend, client net.Addr) *Backend {
+	if len(backends) == 1 {
+		return backends[0]
+	}
+	i := rand.Intn(len(backends))
+	j := rand.Intn(len(backends) - 1)
+	if j >= i {
+		j++
+	}
+	if backends[j].ActiveConns() < backends[i].ActiveConns() {
+		return backends[j]
+	}
+	return backends[i]
+}
+
+// defaultReplicas is the number of points each backend has on the hash ring.
+const defaultReplicas = 100
+
+type sourceHash struct {
+	replicas int
+
+	mu     sync.Mutex
+	key    string // backends the ring was built from
+	hashes []uint32
+	ring   map[uint32]*Backend
+}
+
+// NewSourceHashBalancer creates a Balancer which uses consistent hashing on
+// the client IP, so a client keeps going to the same backend while the set of
+// backends stays the same. replicas is the number of points each backend has
+// on the hash ring; zero means the default.
+func NewSourceHashBalancer(replicas int) Balancer {
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+	return &sourceHash{replicas: replicas}
+}
+
+// Pick picks the backend owning the client IP on the hash ring.
+func (sh *sourceHash) Pick(backends []*Backend, client net.Addr) *Backend {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.build(backends)
+	h := crc32.ChecksumIEEE([]byte(clientIP(client)))
+	i := sort.Search(len(sh.hashes), func(i int) bool { return sh.hashes[i] >= h })
+	if i == len(sh.hashes) {
+		i = 0
+	}
+	return sh.ring[sh.hashes[i]]
+}
+
+// build rebuilds the hash ring if the set of backends changed.
+func (sh *sourceHash) build(backends []*Backend) {
+	names := make([]string, len(backends))
+	for i, b := range backends {
+		names[i] = b.String()
+	}
+	key := strings.Join(names, ",")
+	if key == sh.key && sh.ring != nil {
+		return
+	}
+	sh.key = key
+	sh.hashes = sh.hashes[:0]
+	sh.ring = make(map[uint32]*Backend, len(backends)*sh.replicas)
+	for i, b := range backends {
+		for r := 0; r < sh.replicas; r++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(r) + names[i]))
+			if _, ok := sh.ring[h]; ok {
+				continue
+			}
+			sh.ring[h] = b
+			sh.hashes = append(sh.hashes, h)
+		}
+	}
+	sort.Slice(sh.hashes, func(i, j int) bool { return sh.hashes[i] < sh.hashes[j] })
+}
+
+// clientIP returns the IP part of a client address.
+func clientIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
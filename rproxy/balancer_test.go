@@ -0,0 +1,100 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func testBackends(n int) []*Backend {
+	backends := make([]*Backend, n)
+	for i := range backends {
+		backends[i] = NewBackend("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(i+1)))
+	}
+	return backends
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	backends := testBackends(3)
+	lb := NewRoundRobinBalancer()
+	for i := 0; i < 6; i++ {
+		if b := lb.Pick(backends, nil); b != backends[i%3] {
+			t.Errorf("pick %d: got %v, want %v", i, b, backends[i%3])
+		}
+	}
+}
+
+func TestLeastConnBalancer(t *testing.T) {
+	backends := testBackends(3)
+	backends[0].acquire()
+	backends[2].acquire()
+	lb := NewLeastConnBalancer()
+	if b := lb.Pick(backends, nil); b != backends[1] {
+		t.Errorf("got %v, want %v", b, backends[1])
+	}
+}
+
+func TestRandomTwoBalancer(t *testing.T) {
+	backends := testBackends(2)
+	backends[0].acquire()
+	lb := NewRandomTwoBalancer()
+	for i := 0; i < 10; i++ {
+		if b := lb.Pick(backends, nil); b != backends[1] {
+			t.Errorf("got %v, want %v", b, backends[1])
+		}
+	}
+}
+
+func TestSourceHashBalancer(t *testing.T) {
+	backends := testBackends(5)
+	lb := NewSourceHashBalancer(0)
+	client := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	first := lb.Pick(backends, client)
+	// The port does not matter, only the IP.
+	client.Port = 4321
+	if b := lb.Pick(backends, client); b != first {
+		t.Errorf("got %v, want %v", b, first)
+	}
+	// Removing another backend does not move the client.
+	var rest []*Backend
+	for _, b := range backends {
+		if b != first && len(rest) < 3 {
+			rest = append(rest, b)
+		}
+	}
+	rest = append(rest, first)
+	if b := lb.Pick(rest, client); b != first {
+		t.Errorf("after removal: got %v, want %v", b, first)
+	}
+}
+
+func TestPool(t *testing.T) {
+	p := NewPool(nil)
+	if _, err := p.Pick(nil); err != ErrNoBackend {
+		t.Errorf("empty pool: got %v, want %v", err, ErrNoBackend)
+	}
+	b := NewBackend("TCP", "127.0.0.1:1")
+	p.Add(b)
+	if got, err := p.Pick(nil); got != b || err != nil {
+		t.Errorf("got %v, %v, want %v", got, err, b)
+	}
+	if b.String() != "tcp://127.0.0.1:1" {
+		t.Errorf("string: got %q", b.String())
+	}
+}
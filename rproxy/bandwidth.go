@@ -0,0 +1,137 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"math"
+	"net"
+	"time"
+)
+
+// maxThrottleChunk is the most data read at once from a throttled stream.
+const maxThrottleChunk = 32 * 1024
+
+// Bandwidth is a pair of byte rates in bytes per second, where 0 is
+// unlimited. Upload is from the clients to the backends, and Download from
+// the backends to the clients.
+type Bandwidth struct {
+	Upload   int64
+	Download int64
+}
+
+// BandwidthLimit limits the byte rates of the proxied streams. Each rate
+// allows bursts of one second worth of data.
+type BandwidthLimit struct {
+	Conn   Bandwidth // each connection
+	Client Bandwidth // all the connections of each client, by certificate or IP
+	Route  Bandwidth // all the connections of the route
+}
+
+// SetBandwidthLimit sets the limits on the byte rates of the proxied
+// streams. It must be called before Start.
+func (rp *RProxy) SetBandwidthLimit(l *BandwidthLimit) {
+	rp.bandwidth = l
+}
+
+// bandwidthBuckets holds the token buckets of the shared bandwidth limits,
+// whose tokens are bytes.
+type bandwidthBuckets struct {
+	clientUp, clientDown *tokenBuckets
+	routeUp, routeDown   *tokenBuckets
+}
+
+// newByteBuckets returns the buckets of a byte rate, or nil if unlimited.
+func newByteBuckets(rate int64) *tokenBuckets {
+	if rate <= 0 {
+		return nil
+	}
+	return newTokenBuckets(float64(rate), int(rate))
+}
+
+func newBandwidthBuckets(l *BandwidthLimit) *bandwidthBuckets {
+	return &bandwidthBuckets{
+		clientUp:   newByteBuckets(l.Client.Upload),
+		clientDown: newByteBuckets(l.Client.Download),
+		routeUp:    newByteBuckets(l.Route.Upload),
+		routeDown:  newByteBuckets(l.Route.Download),
+	}
+}
+
+// throttle is one byte rate applying to a stream.
+type throttle struct {
+	buckets *tokenBuckets
+	key     string
+}
+
+// throttles returns the byte rates applying to the upload and download
+// streams of a client connection.
+func (rp *RProxy) throttles(conn net.Conn) (up, down []throttle) {
+	l, bb := rp.bandwidth, rp.bandwidthBuckets
+	if l == nil {
+		return nil, nil
+	}
+	add := func(ts []throttle, buckets *tokenBuckets, key string) []throttle {
+		if buckets == nil {
+			return ts
+		}
+		return append(ts, throttle{buckets: buckets, key: key})
+	}
+	// Each connection has buckets of its own
+	up = add(up, newByteBuckets(l.Conn.Upload), "")
+	down = add(down, newByteBuckets(l.Conn.Download), "")
+	if bb.clientUp != nil || bb.clientDown != nil {
+		client := clientIdentity(conn)
+		up = add(up, bb.clientUp, client)
+		down = add(down, bb.clientDown, client)
+	}
+	up = add(up, bb.routeUp, "")
+	down = add(down, bb.routeDown, "")
+	return up, down
+}
+
+// throttleChunk returns the most data to read at once from a stream with
+// throttles, so that no read exceeds a burst.
+func throttleChunk(throttles []throttle) int {
+	chunk := maxThrottleChunk
+	for _, t := range throttles {
+		chunk = int(math.Min(float64(chunk), t.buckets.burst))
+	}
+	return chunk
+}
+
+// waitThrottles waits until n bytes are allowed by all the throttles, or
+// cancel is closed.
+func waitThrottles(throttles []throttle, n int, cancel <-chan struct{}) {
+	var wait time.Duration
+	now := time.Now()
+	for _, t := range throttles {
+		// The wait is never over the limit, so it cannot fail
+		w, _ := t.buckets.reserve(t.key, float64(n), now, math.MaxInt64)
+		if w > wait {
+			wait = w
+		}
+	}
+	if wait <= 0 {
+		return
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-cancel:
+	}
+}
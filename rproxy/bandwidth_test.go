@@ -0,0 +1,92 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+func TestBandwidthLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 600*1024)
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Banner(string(data))))
+	rp.SetBandwidthLimit(&BandwidthLimit{
+		Conn:  Bandwidth{Download: 400 * 1024},
+		Route: Bandwidth{Upload: 1024},
+	})
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	got, err := io.ReadAll(conn)
+	if err != nil || len(got) != len(data) {
+		t.Fatalf("got %d bytes, %v, want %d", len(got), err, len(data))
+	}
+	// One second worth of data comes at once, then the rest at the rate
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("download took %v, want about 500ms", elapsed)
+	}
+}
+
+func TestThrottles(t *testing.T) {
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", "127.0.0.1:1")
+	rp.SetBandwidthLimit(&BandwidthLimit{
+		Conn:   Bandwidth{Upload: 100},
+		Client: Bandwidth{Upload: 200, Download: 300},
+	})
+	rp.bandwidthBuckets = newBandwidthBuckets(rp.bandwidth)
+	conn := &net.TCPConn{}
+	up, down := rp.throttles(peerAddrConn{conn})
+	if len(up) != 2 || len(down) != 1 {
+		t.Fatalf("got %d upload and %d download throttles, want 2 and 1", len(up), len(down))
+	}
+	if chunk := throttleChunk(up); chunk != 100 {
+		t.Errorf("got chunk %d, want the smallest burst 100", chunk)
+	}
+	// The client throttles are shared by the connections of the client
+	up2, _ := rp.throttles(peerAddrConn{conn})
+	if up[1].buckets != up2[1].buckets || up[1].key != up2[1].key || up[0].buckets == up2[0].buckets {
+		t.Errorf("client throttles not shared, or connection throttles shared")
+	}
+	// Waits are cut short by cancel
+	cancel := make(chan struct{})
+	close(cancel)
+	start := time.Now()
+	waitThrottles(up, 10000, cancel)
+	if time.Since(start) > time.Second {
+		t.Errorf("wait not canceled")
+	}
+}
+
+// peerAddrConn is a connection from a fixed client address.
+type peerAddrConn struct {
+	net.Conn
+}
+
+func (peerAddrConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+}
@@ -0,0 +1,202 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// maxClientHelloSize bounds the bytes buffered while reading a ClientHello.
+const maxClientHelloSize = 64 * 1024
+
+var errNotClientHello = errors.New("not a TLS ClientHello")
+
+// clientHello holds what the proxy needs from a TLS ClientHello.
+type clientHello struct {
+	serverName string   // server_name extension
+	alpn       []string // application_layer_protocol_negotiation extension
+}
+
+// readClientHello reads the TLS records carrying a ClientHello from r without
+// decrypting anything. It returns the raw bytes read, which must be replayed
+// to the backend, and the parsed ClientHello.
+func readClientHello(r io.Reader) ([]byte, *clientHello, error) {
+	var raw, msg []byte
+	// A handshake message may span several records
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, nil, err
+		}
+		if header[0] != 0x16 { // handshake record
+			return nil, nil, errNotClientHello
+		}
+		n := int(binary.BigEndian.Uint16(header[3:5]))
+		if len(raw)+5+n > maxClientHelloSize {
+			return nil, nil, errors.New("ClientHello too large")
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, nil, err
+		}
+		raw = append(append(raw, header[:]...), body...)
+		msg = append(msg, body...)
+		if len(msg) < 4 {
+			continue
+		}
+		if msg[0] != 0x01 { // client_hello
+			return nil, nil, errNotClientHello
+		}
+		size := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+		if len(msg) >= 4+size {
+			hello, err := parseClientHello(msg[4 : 4+size])
+			return raw, hello, err
+		}
+	}
+}
+
+// parseClientHello parses the body of a ClientHello message.
+func parseClientHello(b []byte) (*clientHello, error) {
+	s := helloReader(b)
+	// Skip client_version, random, session_id, cipher_suites, and
+	// compression_methods
+	if !s.skip(2+32) || !s.skipVector(1) || !s.skipVector(2) || !s.skipVector(1) {
+		return nil, errNotClientHello
+	}
+	hello := &clientHello{}
+	if len(s) == 0 {
+		// No extensions
+		return hello, nil
+	}
+	exts, ok := s.vector(2)
+	if !ok {
+		return nil, errNotClientHello
+	}
+	for len(exts) > 0 {
+		typ, ok1 := exts.uint16()
+		data, ok2 := exts.vector(2)
+		if !ok1 || !ok2 {
+			return nil, errNotClientHello
+		}
+		switch typ {
+		case 0: // server_name
+			names, ok := data.vector(2)
+			for ok && len(names) > 0 {
+				var nameType []byte
+				var name helloReader
+				if nameType, ok = names.bytes(1); !ok {
+					break
+				}
+				if name, ok = names.vector(2); ok && nameType[0] == 0 { // host_name
+					hello.serverName = string(name)
+				}
+			}
+			if !ok {
+				return nil, errNotClientHello
+			}
+		case 16: // application_layer_protocol_negotiation
+			protos, ok := data.vector(2)
+			for ok && len(protos) > 0 {
+				var proto helloReader
+				if proto, ok = protos.vector(1); ok {
+					hello.alpn = append(hello.alpn, string(proto))
+				}
+			}
+			if !ok {
+				return nil, errNotClientHello
+			}
+		}
+	}
+	return hello, nil
+}
+
+// helloReader reads the fields of a TLS handshake message.
+type helloReader []byte
+
+func (s *helloReader) bytes(n int) ([]byte, bool) {
+	if len(*s) < n {
+		return nil, false
+	}
+	b := (*s)[:n]
+	*s = (*s)[n:]
+	return b, true
+}
+
+func (s *helloReader) skip(n int) bool {
+	_, ok := s.bytes(n)
+	return ok
+}
+
+func (s *helloReader) uint16() (uint16, bool) {
+	b, ok := s.bytes(2)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(b), true
+}
+
+// vector reads a vector with a length prefix of lenSize bytes.
+func (s *helloReader) vector(lenSize int) (helloReader, bool) {
+	b, ok := s.bytes(lenSize)
+	if !ok {
+		return nil, false
+	}
+	n := 0
+	for _, c := range b {
+		n = n<<8 | int(c)
+	}
+	v, ok := s.bytes(n)
+	return helloReader(v), ok
+}
+
+func (s *helloReader) skipVector(lenSize int) bool {
+	_, ok := s.vector(lenSize)
+	return ok
+}
+
+// peekedConn is a client connection whose ClientHello has been read by the
+// proxy. Reads replay the ClientHello before the rest of the stream.
+type peekedConn struct {
+	net.Conn
+	r     io.Reader
+	hello *clientHello
+}
+
+func newPeekedConn(conn net.Conn, raw []byte, hello *clientHello) *peekedConn {
+	return &peekedConn{
+		Conn:  conn,
+		r:     io.MultiReader(bytes.NewReader(raw), conn),
+		hello: hello,
+	}
+}
+
+// Read reads the replayed ClientHello, then the connection.
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite shuts down the writing side of the connection.
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
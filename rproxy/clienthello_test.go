@@ -0,0 +1,85 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+func TestReadClientHello(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() {
+		tls.Client(c2, &tls.Config{ServerName: "www.example.com", NextProtos: []string{"h2", "http/1.1"}}).Handshake()
+		c2.Close()
+	}()
+	raw, hello, err := readClientHello(c1)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if hello.serverName != "www.example.com" {
+		t.Errorf("server name: got %q", hello.serverName)
+	}
+	if len(hello.alpn) != 2 || hello.alpn[0] != "h2" || hello.alpn[1] != "http/1.1" {
+		t.Errorf("alpn: got %q", hello.alpn)
+	}
+	if len(raw) < 5 || raw[0] != 0x16 {
+		t.Errorf("raw: got % x", raw)
+	}
+
+	if _, _, err := readClientHello(bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n"))); err != errNotClientHello {
+		t.Errorf("http request: got %v, want %v", err, errNotClientHello)
+	}
+	if _, _, err := readClientHello(bytes.NewReader(raw[:len(raw)-1])); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	pki := newTestPKI(t)
+	rp := NewRProxyWithoutCerts("sni", "127.0.0.1:0", "tcp", backendtest.Start(t, tlsListener(t, pki.serverConfig("default.test")), backendtest.Banner("default")))
+	rp.AddSNIRoute(&SNIRoute{
+		ServerName: "a.example.com",
+		Pool:       NewPool(nil, NewBackend("tcp", backendtest.Start(t, tlsListener(t, pki.serverConfig("a.example.com")), backendtest.Banner("a")))),
+	})
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	// The backends terminate TLS with their own certificates.
+	for _, serverName := range []string{"a.example.com", "default.test"} {
+		conn, err := tls.Dial("tcp", addr, pki.clientConfig("testapp-client-0", serverName))
+		if err != nil {
+			t.Errorf("%s: dial error: %v", serverName, err)
+			continue
+		}
+		got, _ := io.ReadAll(conn)
+		conn.Close()
+		want := "default"
+		if serverName == "a.example.com" {
+			want = "a"
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", serverName, got, want)
+		}
+	}
+}
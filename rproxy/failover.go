@@ -0,0 +1,150 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultFailoverCooldown is how long a failover balancer skips a backend
+// after a dial to it fails.
+const DefaultFailoverCooldown = 10 * time.Second
+
+// errFailedOver is returned for a connection dialed to a backend the pool
+// failed over from while dialing.
+var errFailedOver = errors.New("rproxy: backend failed over")
+
+// DialObserver is implemented by the balancers which act on the outcome of
+// the dials to the backends.
+type DialObserver interface {
+	// DialFailed is called when dialing or the handshake to b fails.
+	DialFailed(b *Backend)
+	// DialSucceeded is called when a connection to b is established.
+	DialSucceeded(b *Backend)
+}
+
+type failover struct {
+	cooldown time.Duration
+
+	mu     sync.Mutex
+	failed map[*Backend]time.Time // backends skipped until the time
+	active *Backend
+}
+
+// NewFailoverBalancer creates a Balancer which sends all the connections to
+// one backend at a time: the first one in the pool, the primary, unless it is
+// unhealthy or a dial to it failed within cooldown, then the next one, and so
+// on. Zero cooldown means the default. Once a connection to another backend
+// succeeds, those open to the previous one are closed, so that no two
+// backends ever serve at once.
+func NewFailoverBalancer(cooldown time.Duration) Balancer {
+	if cooldown <= 0 {
+		cooldown = DefaultFailoverCooldown
+	}
+	return &failover{cooldown: cooldown, failed: make(map[*Backend]time.Time)}
+}
+
+// Pick picks the first backend not cooling down after a failed dial, or the
+// one cooling down the shortest if all are.
+func (f *failover) Pick(backends []*Backend, client net.Addr) *Backend {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	var pick *Backend
+	for _, b := range backends {
+		until, ok := f.failed[b]
+		if !ok || !now.Before(until) {
+			delete(f.failed, b)
+			pick = b
+			break
+		}
+		if pick == nil || until.Before(f.failed[pick]) {
+			pick = b
+		}
+	}
+	return pick
+}
+
+// wantsAllBackends reports true, as skipping the full primary would fail
+// over without it failing.
+func (f *failover) wantsAllBackends() bool {
+	return true
+}
+
+// DialFailed makes Pick skip b for the cooldown.
+func (f *failover) DialFailed(b *Backend) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failed[b] = time.Now().Add(f.cooldown)
+}
+
+// DialSucceeded makes b the active backend, fencing off the previous one.
+// The backend picked is not fenced off before, so that the active one keeps
+// serving while the other is still failing.
+func (f *failover) DialSucceeded(b *Backend) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if b == f.active {
+		return
+	}
+	if f.active != nil {
+		f.active.fence()
+	}
+	b.unfence()
+	f.active = b
+}
+
+// track registers a connection proxied to the backend. It reports false if
+// the backend is fenced off, in which case the connection must not be used.
+func (b *Backend) track(conn net.Conn) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.fenced {
+		return false
+	}
+	if b.conns == nil {
+		b.conns = make(map[net.Conn]struct{})
+	}
+	b.conns[conn] = struct{}{}
+	return true
+}
+
+func (b *Backend) untrack(conn net.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.conns, conn)
+}
+
+// fence closes the connections to the backend and refuses new ones until
+// unfence is called.
+func (b *Backend) fence() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fenced = true
+	for conn := range b.conns {
+		conn.Close()
+	}
+}
+
+func (b *Backend) unfence() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fenced = false
+}
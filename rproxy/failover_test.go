@@ -0,0 +1,163 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+func TestFailoverBalancer(t *testing.T) {
+	backends := testBackends(3)
+	lb := NewFailoverBalancer(50 * time.Millisecond)
+	o := lb.(DialObserver)
+	if b := lb.Pick(backends, nil); b != backends[0] {
+		t.Errorf("got %v, want the primary %v", b, backends[0])
+	}
+	o.DialSucceeded(backends[0])
+	c0, c1 := net.Pipe()
+	defer c1.Close()
+	if !backends[0].track(c0) {
+		t.Fatalf("primary refused a connection")
+	}
+	o.DialFailed(backends[0])
+	if b := lb.Pick(backends, nil); b != backends[1] {
+		t.Errorf("after failure: got %v, want %v", b, backends[1])
+	}
+	// The connections to the primary are kept until the standby is dialed
+	if !backends[0].track(c0) {
+		t.Errorf("primary fenced off before the standby was dialed")
+	}
+	o.DialSucceeded(backends[1])
+	if _, err := c1.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection to the primary: got %v, want EOF", err)
+	}
+	if backends[0].track(c0) {
+		t.Errorf("primary accepted a connection after failing over")
+	}
+	o.DialFailed(backends[1])
+	o.DialFailed(backends[2])
+	if b := lb.Pick(backends, nil); b != backends[0] {
+		t.Errorf("all failed: got %v, want %v", b, backends[0])
+	}
+	time.Sleep(60 * time.Millisecond)
+	if b := lb.Pick(backends, nil); b != backends[0] {
+		t.Errorf("after cooldown: got %v, want %v", b, backends[0])
+	}
+	o.DialSucceeded(backends[0])
+	if !backends[0].track(c0) {
+		t.Errorf("primary refused a connection after failing back")
+	}
+}
+
+func readName(t *testing.T, addr string) (net.Conn, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	n, _ := conn.Read(buf)
+	return conn, string(buf[:n])
+}
+
+func TestFailover(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	primary := ln.Addr().String()
+	ln.Close()
+	standby, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer standby.Close()
+	backendtest.Start(t, standby, backendtest.Named("standby"))
+
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", primary)
+	rp.AddBackend("tcp", standby.Addr().String())
+	rp.SetBalancer(NewFailoverBalancer(100 * time.Millisecond))
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	// The primary is down, so the standby serves
+	conn, name := readName(t, addr)
+	defer conn.Close()
+	if name != "standby" {
+		t.Fatalf("got %q, want standby", name)
+	}
+	// Once the primary is back, it serves and the standby no longer does
+	ln, err = net.Listen("tcp", primary)
+	if err != nil {
+		t.Skipf("primary address taken: %v", err)
+	}
+	defer ln.Close()
+	backendtest.Start(t, ln, backendtest.Named("primary"))
+	time.Sleep(150 * time.Millisecond)
+	conn2, name := readName(t, addr)
+	defer conn2.Close()
+	if name != "primary" {
+		t.Errorf("after recovery: got %q, want primary", name)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection to the standby: got %v, want EOF", err)
+	}
+}
+
+func TestFailoverPrimaryStillDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	primary := ln.Addr().String()
+	ln.Close()
+	standby, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer standby.Close()
+	backendtest.Start(t, standby, backendtest.Named("standby"))
+
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", primary)
+	rp.AddBackend("tcp", standby.Addr().String())
+	rp.SetBalancer(NewFailoverBalancer(50 * time.Millisecond))
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	conn, name := readName(t, addr)
+	defer conn.Close()
+	if name != "standby" {
+		t.Fatalf("got %q, want standby", name)
+	}
+	// The primary is retried past the cooldown, and fails again
+	time.Sleep(100 * time.Millisecond)
+	conn2, name := readName(t, addr)
+	defer conn2.Close()
+	if name != "standby" {
+		t.Errorf("after cooldown: got %q, want standby", name)
+	}
+	// The session to the standby survives
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err == io.EOF {
+		t.Errorf("connection to the standby closed while the primary is down")
+	}
+}
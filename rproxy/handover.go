@@ -0,0 +1,107 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"net"
+	"time"
+)
+
+// deadliner is implemented by the listeners whose blocked Accept or ReadFrom
+// can be woken up, so that they can be handed over.
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// listenNetwork returns the network the proxy listens on.
+func (rp *RProxy) listenNetwork() string {
+	switch rp.listenProto {
+	case "udp", "unix":
+		return rp.listenProto
+	default:
+		return "tcp"
+	}
+}
+
+// sameListen reports whether the route rp replaces listens on the same
+// network and address as rp.
+func (rp *RProxy) sameListen() bool {
+	old := rp.replaces
+	if old == nil || old.listenNetwork() != rp.listenNetwork() {
+		return false
+	}
+	if old.listenAddr == rp.listenAddr {
+		return true
+	}
+	// The old route may listen on the port picked for its address
+	addr := old.Addr()
+	return addr != nil && addr.String() == rp.listenAddr
+}
+
+// inheritListener takes over the listener of the route rp replaces if it
+// listens on the same address, or returns nil.
+func (rp *RProxy) inheritListener() net.Listener {
+	if !rp.sameListen() {
+		return nil
+	}
+	ln, _ := rp.replaces.handOver()
+	return ln
+}
+
+// inheritPacketConn is like inheritListener for udp.
+func (rp *RProxy) inheritPacketConn() net.PacketConn {
+	if !rp.sameListen() {
+		return nil
+	}
+	_, pc := rp.replaces.handOver()
+	return pc
+}
+
+// handOver stops the proxy from accepting connections, and returns its
+// listener, still open, for the route replacing it. It returns nil if the
+// proxy is closed or its listener cannot be woken up.
+func (rp *RProxy) handOver() (net.Listener, net.PacketConn) {
+	rp.mu.Lock()
+	ln, pc, served := rp.listener, rp.packetConn, rp.served
+	var d deadliner
+	if pc != nil {
+		d = pc
+	} else if ln != nil {
+		d, _ = ln.(deadliner)
+	}
+	if rp.closed || d == nil {
+		rp.mu.Unlock()
+		return nil, nil
+	}
+	rp.closed = true
+	rp.handedOver = true
+	rp.listener, rp.packetConn = nil, nil
+	rp.mu.Unlock()
+	// Wake the serving loop up and wait for it to return
+	if served != nil {
+		d.SetDeadline(time.Now())
+		<-served
+		d.SetDeadline(time.Time{})
+	}
+	return ln, pc
+}
+
+func (rp *RProxy) isHandedOver() bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.handedOver
+}
@@ -0,0 +1,165 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Health check modes.
+const (
+	HealthCheckTCP     = "tcp"     // connect to the backend
+	HealthCheckTLS     = "tls"     // connect and complete a TLS handshake
+	HealthCheckPayload = "payload" // connect, send Send, and expect Expect
+)
+
+// HealthCheck configures how backends are probed. Backends failing a probe
+// are taken out of rotation until a later probe succeeds.
+type HealthCheck struct {
+	Mode     string        // tcp, tls, or payload
+	Interval time.Duration // time between probes
+	Timeout  time.Duration // time allowed for a probe
+	// Send is written to the backend in payload mode, through TLS if the
+	// backend protocol is tls.
+	Send []byte
+	// Expect is the prefix the backend must respond with in payload mode.
+	Expect []byte
+}
+
+// Default health check settings.
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 5 * time.Second
+)
+
+// Healthy reports whether the backend passed its last health check. Backends
+// are healthy until a check fails.
+func (b *Backend) Healthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.down
+}
+
+// setHealthy records the result of a health check and reports whether the
+// state of the backend changed.
+func (b *Backend) setHealthy(healthy bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down == !healthy {
+		return false
+	}
+	b.down = !healthy
+	return true
+}
+
+// SetHealthCheck enables active health checking of the backends. It must be
+// called before Start.
+func (rp *RProxy) SetHealthCheck(hc *HealthCheck) {
+	rp.healthCheck = hc
+}
+
+// checkHealth probes the backends periodically until stop is closed.
+func (rp *RProxy) checkHealth(stop <-chan struct{}) {
+	hc := *rp.healthCheck
+	if hc.Interval <= 0 {
+		hc.Interval = DefaultHealthCheckInterval
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = DefaultHealthCheckTimeout
+	}
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, p := range rp.pools() {
+			clientConfig := rp.clientConfigFor(p)
+			for _, b := range p.Backends() {
+				wg.Add(1)
+				go func(b *Backend) {
+					defer wg.Done()
+					err := rp.probe(&hc, b, clientConfig)
+					if b.setHealthy(err == nil) {
+						if err != nil {
+							rp.logf("backend %v is down: %v", b, err)
+						} else {
+							rp.logf("backend %v is up", b)
+						}
+					}
+				}(b)
+			}
+		}
+		wg.Wait()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe runs one health check against a backend.
+func (rp *RProxy) probe(hc *HealthCheck, b *Backend, clientConfig *tls.Config) error {
+	conn, err := net.DialTimeout(b.network(), b.Addr, hc.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(hc.Timeout))
+	if header := rp.localProxyHeader(); header != nil {
+		if _, err := conn.Write(header); err != nil {
+			return err
+		}
+	}
+	// Unix socket paths are no server names
+	if (hc.Mode == HealthCheckTLS || b.Proto == "tls") && b.Proto != "unix" {
+		if clientConfig, err = withServerName(clientConfig, b.Addr); err != nil {
+			return err
+		}
+	}
+	switch hc.Mode {
+	case "", HealthCheckTCP:
+		return nil
+	case HealthCheckTLS:
+		return tls.Client(conn, clientConfig).Handshake()
+	case HealthCheckPayload:
+		if b.Proto == "tls" {
+			conn = tls.Client(conn, clientConfig)
+		}
+		if len(hc.Send) > 0 {
+			if _, err := conn.Write(hc.Send); err != nil {
+				return err
+			}
+		}
+		resp := make([]byte, len(hc.Expect))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if !bytes.Equal(resp, hc.Expect) {
+			return fmt.Errorf("unexpected response %q", resp)
+		}
+		return nil
+	default:
+		return errors.New("health check mode not supported")
+	}
+}
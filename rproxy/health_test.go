@@ -0,0 +1,103 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+func TestHealthCheck(t *testing.T) {
+	// Reserve an address with nothing listening on it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	deadAddr := ln.Addr().String()
+	ln.Close()
+
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Echo))
+	rp.AddBackend("tcp", deadAddr)
+	rp.SetHealthCheck(&HealthCheck{
+		Mode:     HealthCheckPayload,
+		Interval: 10 * time.Millisecond,
+		Send:     []byte("ping"),
+		Expect:   []byte("ping"),
+	})
+	startProxy(t, rp)
+	defer rp.Close()
+
+	backends := rp.Backends()
+	for i := 0; i < 100 && backends[1].Healthy(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !backends[0].Healthy() {
+		t.Errorf("backend %v: got unhealthy, want healthy", backends[0])
+	}
+	if backends[1].Healthy() {
+		t.Errorf("backend %v: got healthy, want unhealthy", backends[1])
+	}
+	for i := 0; i < 4; i++ {
+		if b, err := rp.pool.Pick(nil); b != backends[0] {
+			t.Errorf("pick: got %v, %v, want %v", b, err, backends[0])
+		}
+	}
+}
+
+func TestTLSHealthCheckServerName(t *testing.T) {
+	// The client config sets no server name, so the host of the backend
+	// address is verified as when dialing
+	pki := newTestPKI(t)
+	cert := pki.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "backend"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	})
+	server := &tls.Config{
+		ClientCAs:    pki.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		Certificates: []tls.Certificate{cert},
+	}
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tls", backendtest.Start(t, tlsListener(t, server), backendtest.Banner("ok")))
+	rp.SetClientConfig(pki.clientConfig("testapp-client", ""))
+	rp.SetHealthCheck(&HealthCheck{Mode: HealthCheckTLS, Interval: time.Hour, Timeout: time.Second})
+	b := rp.Backends()[0]
+	if err := rp.probe(rp.healthCheck, b, rp.clientConfig); err != nil {
+		t.Errorf("probe error: %v", err)
+	}
+}
+
+func TestTLSHealthCheckUnix(t *testing.T) {
+	// Socket paths are not taken for server names
+	pki := newTestPKI(t)
+	cert := pki.issue(&x509.Certificate{Subject: pkix.Name{CommonName: "backend"}})
+	server := &tls.Config{Certificates: []tls.Certificate{cert}}
+	ln := tls.NewListener(backendtest.Listen(t, "unix", filepath.Join(t.TempDir(), "backend.sock")), server)
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "unix", backendtest.Start(t, ln, backendtest.Banner("ok")))
+	rp.SetClientConfig(&tls.Config{InsecureSkipVerify: true})
+	rp.SetHealthCheck(&HealthCheck{Mode: HealthCheckTLS, Interval: time.Hour, Timeout: time.Second})
+	b := rp.Backends()[0]
+	if err := rp.probe(rp.healthCheck, b, rp.clientConfig); err != nil {
+		t.Errorf("probe error: %v", err)
+	}
+}
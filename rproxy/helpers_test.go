@@ -0,0 +1,85 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+// tlsListener listens for TLS connections on a local TCP port.
+func tlsListener(t *testing.T, config *tls.Config) net.Listener {
+	return tls.NewListener(backendtest.Listen(t, "tcp", "127.0.0.1:0"), config)
+}
+
+// writeProtocol writes the protocol negotiated by a TLS connection to it,
+// then closes it.
+func writeProtocol(conn net.Conn) {
+	if err := conn.(*tls.Conn).Handshake(); err == nil {
+		conn.Write([]byte("backend:" + conn.(*tls.Conn).ConnectionState().NegotiatedProtocol))
+	}
+	conn.Close()
+}
+
+// readLine returns a serve function sending the first line read from the
+// connection to lines.
+func readLine(lines chan string) func(net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		lines <- line
+	}
+}
+
+// sendProxyHeaderV2 returns a serve function sending the PROXY protocol
+// version 2 header read from the connection to headers.
+func sendProxyHeaderV2(headers chan []byte) func(net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		header := make([]byte, 16)
+		io.ReadFull(conn, header)
+		header = append(header, make([]byte, binary.BigEndian.Uint16(header[14:]))...)
+		io.ReadFull(conn, header[16:])
+		headers <- header
+	}
+}
+
+// startUDPEcho starts a UDP server echoing each datagram back to its sender.
+func startUDPEcho(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
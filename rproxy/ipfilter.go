@@ -0,0 +1,71 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// IPFilter allows or denies clients by their IP addresses. A client is denied
+// if any deny network contains its address, and otherwise allowed if there
+// are no allow networks or any of them contains its address.
+type IPFilter struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// Allowed reports whether the client at addr is allowed.
+func (f *IPFilter) Allowed(addr net.Addr) bool {
+	if containsAddr(f.Deny, addr) {
+		return false
+	}
+	return len(f.Allow) == 0 || containsAddr(f.Allow, addr)
+}
+
+// SetIPFilter sets the filter checked on the connections as soon as they are
+// accepted, before any TLS handshake. Connections from trusted proxies are
+// checked with the client address of their PROXY protocol header instead. It
+// may be called while the proxy is running, and a nil filter allows all
+// clients. Unix listeners support no filter.
+func (rp *RProxy) SetIPFilter(f *IPFilter) {
+	rp.ipFilter.Store(f)
+}
+
+// IPFilter returns the filter set by SetIPFilter.
+func (rp *RProxy) IPFilter() *IPFilter {
+	f, _ := rp.ipFilter.Load().(*IPFilter)
+	return f
+}
+
+// RejectedConns returns the number of connections rejected by the IP filter.
+func (rp *RProxy) RejectedConns() int64 {
+	return atomic.LoadInt64(&rp.rejected)
+}
+
+// admit checks a client connection against the IP filter, and closes it if
+// it is rejected.
+func (rp *RProxy) admit(conn net.Conn) bool {
+	f := rp.IPFilter()
+	if f == nil || f.Allowed(conn.RemoteAddr()) {
+		return true
+	}
+	atomic.AddInt64(&rp.rejected, 1)
+	rp.logf("ip filter: %v rejected", conn.RemoteAddr())
+	conn.Close()
+	return false
+}
@@ -0,0 +1,115 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+func TestIPFilterAllowed(t *testing.T) {
+	allow, _ := ParseCIDRs([]string{"10.0.0.0/8", "2001:db8::/32"})
+	deny, _ := ParseCIDRs([]string{"10.1.0.0/16", "2001:db8::1"})
+	f := &IPFilter{Allow: allow, Deny: deny}
+	tests := []struct {
+		ip    string
+		allow bool
+	}{
+		{"10.0.0.1", true},
+		{"10.1.2.3", false},
+		{"192.0.2.1", false},
+		{"2001:db8::2", true},
+		{"2001:db8::1", false},
+		{"::ffff:10.0.0.1", true},
+	}
+	for _, tt := range tests {
+		addr := &net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 1}
+		if got := f.Allowed(addr); got != tt.allow {
+			t.Errorf("%s: got %v, want %v", tt.ip, got, tt.allow)
+		}
+	}
+	if !(&IPFilter{Deny: deny}).Allowed(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}) {
+		t.Errorf("deny only filter rejected an address it does not list")
+	}
+}
+
+func TestIPFilterListener(t *testing.T) {
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Banner("hello")))
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	read := func() string {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		defer conn.Close()
+		got, _ := io.ReadAll(conn)
+		return string(got)
+	}
+	if got := read(); got != "hello" {
+		t.Errorf("without filter: got %q", got)
+	}
+	// Filters apply to running listeners
+	deny, _ := ParseCIDRs([]string{"127.0.0.0/8"})
+	rp.SetIPFilter(&IPFilter{Deny: deny})
+	if got := read(); got != "" {
+		t.Errorf("denied: got %q", got)
+	}
+	if n := rp.RejectedConns(); n != 1 {
+		t.Errorf("got %d rejected connections, want 1", n)
+	}
+	rp.SetIPFilter(nil)
+	if got := read(); got != "hello" {
+		t.Errorf("filter removed: got %q", got)
+	}
+}
+
+func TestIPFilterProxyProtocol(t *testing.T) {
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Banner("hello")))
+	trusted, _ := ParseCIDRs([]string{"127.0.0.1"})
+	rp.SetAcceptProxyProtocol(trusted)
+	deny, _ := ParseCIDRs([]string{"192.0.2.0/24"})
+	rp.SetIPFilter(&IPFilter{Deny: deny})
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	// The filter applies to the client address of the header
+	dst := &net.TCPAddr{IP: net.ParseIP("203.0.113.1").To4(), Port: 443}
+	for _, tt := range []struct {
+		client string
+		want   string
+	}{
+		{"198.51.100.7", "hello"},
+		{"192.0.2.7", ""},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		src := &net.TCPAddr{IP: net.ParseIP(tt.client).To4(), Port: 5000}
+		conn.Write(proxyHeaderV1(src, dst))
+		got, _ := io.ReadAll(conn)
+		conn.Close()
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.client, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrLimitReached is returned when a connection is rejected by a Limiter.
+var ErrLimitReached = errors.New("connection limit reached")
+
+// Limiter limits the number of concurrent connections. Connections over the
+// limit wait in a queue for up to a timeout, and are rejected if the queue is
+// full or the timeout expires. A Limiter may be shared by many routes or
+// backends.
+type Limiter struct {
+	max      int
+	queue    int
+	timeout  time.Duration
+	sem      chan struct{}
+	mu       sync.Mutex
+	waiting  int
+	rejected int64
+}
+
+// NewLimiter creates a Limiter allowing max concurrent connections, with up to
+// queue more waiting for at most timeout. With a queue of 0, connections over
+// the limit are rejected at once.
+func NewLimiter(max, queue int, timeout time.Duration) *Limiter {
+	if max < 1 {
+		max = 1
+	}
+	return &Limiter{
+		max:     max,
+		queue:   queue,
+		timeout: timeout,
+		sem:     make(chan struct{}, max),
+	}
+}
+
+// Max returns the maximum number of concurrent connections.
+func (l *Limiter) Max() int {
+	return l.max
+}
+
+// Active returns the number of connections holding the limiter.
+func (l *Limiter) Active() int {
+	return len(l.sem)
+}
+
+// Waiting returns the number of connections in the queue.
+func (l *Limiter) Waiting() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.waiting
+}
+
+// Rejected returns the number of connections rejected.
+func (l *Limiter) Rejected() int64 {
+	return atomic.LoadInt64(&l.rejected)
+}
+
+// full reports whether a new connection would have to wait.
+func (l *Limiter) full() bool {
+	return len(l.sem) >= l.max
+}
+
+// acquire takes a place for a connection, waiting in the queue if needed.
+// It gives up if cancel is closed.
+func (l *Limiter) acquire(cancel <-chan struct{}) error {
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	default:
+	}
+	l.mu.Lock()
+	if l.waiting >= l.queue {
+		l.mu.Unlock()
+		atomic.AddInt64(&l.rejected, 1)
+		return ErrLimitReached
+	}
+	l.waiting++
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.waiting--
+		l.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-timer.C:
+	case <-cancel:
+	}
+	atomic.AddInt64(&l.rejected, 1)
+	return ErrLimitReached
+}
+
+// release gives back the place of a connection.
+func (l *Limiter) release() {
+	<-l.sem
+}
+
+// SetConnLimit limits the number of concurrent client connections of the
+// route. It must be called before Start.
+func (rp *RProxy) SetConnLimit(l *Limiter) {
+	rp.connLimit = l
+}
+
+// ConnLimit returns the limiter set by SetConnLimit.
+func (rp *RProxy) ConnLimit() *Limiter {
+	return rp.connLimit
+}
+
+// setGlobalLimit sets the limiter shared by the routes of a Server.
+func (rp *RProxy) setGlobalLimit(l *Limiter) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.globalLimit = l
+}
+
+// limiters returns the limiters a client connection must acquire, the
+// global one first.
+func (rp *RProxy) limiters() []*Limiter {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	var limiters []*Limiter
+	if rp.globalLimit != nil {
+		limiters = append(limiters, rp.globalLimit)
+	}
+	if rp.connLimit != nil {
+		limiters = append(limiters, rp.connLimit)
+	}
+	return limiters
+}
+
+// SetConnLimit limits the number of concurrent client connections of all the
+// routes together. It may be called while the server is running, and applies
+// to the connections accepted afterwards.
+func (s *Server) SetConnLimit(l *Limiter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = l
+	for _, rp := range s.routes {
+		rp.setGlobalLimit(l)
+	}
+}
+
+// ConnLimit returns the limiter set by SetConnLimit.
+func (s *Server) ConnLimit() *Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limit
+}
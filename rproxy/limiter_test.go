@@ -0,0 +1,129 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(1, 1, 50*time.Millisecond)
+	if err := l.acquire(nil); err != nil {
+		t.Fatalf("acquire error: %v", err)
+	}
+	// The queue holds one connection, until the timeout
+	errc := make(chan error, 1)
+	go func() { errc <- l.acquire(nil) }()
+	for l.Waiting() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := l.acquire(nil); err != ErrLimitReached {
+		t.Errorf("got %v with a full queue, want ErrLimitReached", err)
+	}
+	if err := <-errc; err != ErrLimitReached {
+		t.Errorf("got %v after the timeout, want ErrLimitReached", err)
+	}
+	// A release lets the next connection in
+	go func() { errc <- l.acquire(nil) }()
+	for l.Waiting() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	l.release()
+	if err := <-errc; err != nil {
+		t.Errorf("got %v after a release", err)
+	}
+	// Waiting connections give up when canceled
+	cancel := make(chan struct{})
+	go func() { errc <- l.acquire(cancel) }()
+	for l.Waiting() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(cancel)
+	if err := <-errc; err != ErrLimitReached {
+		t.Errorf("got %v when canceled, want ErrLimitReached", err)
+	}
+	if l.Active() != 1 || l.Rejected() != 3 {
+		t.Errorf("got %d active, %d rejected, want 1, 3", l.Active(), l.Rejected())
+	}
+}
+
+func TestConnLimit(t *testing.T) {
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Echo))
+	l := NewLimiter(1, 1, 5*time.Second)
+	rp.SetConnLimit(l)
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		return conn
+	}
+	echo := func(conn net.Conn) string {
+		conn.Write([]byte("x"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 1)
+		n, _ := conn.Read(b)
+		return string(b[:n])
+	}
+	first := dial()
+	defer first.Close()
+	if got := echo(first); got != "x" {
+		t.Fatalf("first connection: got %q", got)
+	}
+	second := dial()
+	defer second.Close()
+	for l.Waiting() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	// The queue is full, so the third connection is rejected
+	third := dial()
+	if got, _ := io.ReadAll(third); len(got) != 0 {
+		t.Errorf("third connection: got %q", got)
+	}
+	third.Close()
+	// The second connection is served once the first is done
+	first.Close()
+	if got := echo(second); got != "x" {
+		t.Errorf("second connection: got %q", got)
+	}
+}
+
+func TestBackendConnLimit(t *testing.T) {
+	full, free := NewBackend("tcp", "127.0.0.1:1"), NewBackend("tcp", "127.0.0.1:2")
+	full.SetConnLimit(NewLimiter(1, 0, 0))
+	full.ConnLimit().acquire(nil)
+	free.SetConnLimit(NewLimiter(1, 0, 0))
+	p := NewPool(nil, full, free)
+	for i := 0; i < 3; i++ {
+		if b, _ := p.Pick(nil); b != free {
+			t.Errorf("picked %v, want the backend below its limit", b)
+		}
+	}
+	// Once all are at their limit, any is picked to wait in its queue
+	free.ConnLimit().acquire(nil)
+	if b, err := p.Pick(nil); b == nil {
+		t.Errorf("got %v with all backends at their limit", err)
+	}
+}
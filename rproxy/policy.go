@@ -0,0 +1,176 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// CertPolicy authorizes the clients of a TLS listener by their verified
+// certificates. A client is denied if any deny rule matches its certificate,
+// and otherwise allowed if there are no allow rules or any of them matches.
+type CertPolicy struct {
+	Allow []CertRule
+	Deny  []CertRule
+}
+
+// CertRule matches a client certificate. Its fields are patterns as in
+// path.Match, such as *.example.com, where * does not match a /. A rule
+// matches if all its non-empty fields match, and an empty rule matches any
+// certificate.
+type CertRule struct {
+	CommonName string // subject common name
+	DNSName    string // any DNS SAN
+	URI        string // any URI SAN, such as spiffe://example.com/team-a/*
+	OU         string // any subject organizational unit
+	Issuer     string // issuer common name, or its full name in RFC 2253 form
+}
+
+// SetCertPolicy sets the policy authorizing the clients of the TLS listener,
+// for the connections not matching an SNI route with its own policy. It must
+// be called before Start.
+func (rp *RProxy) SetCertPolicy(policy *CertPolicy) {
+	rp.certPolicy = policy
+}
+
+// Validate checks the patterns of the rules.
+func (p *CertPolicy) Validate() error {
+	for _, rules := range [][]CertRule{p.Allow, p.Deny} {
+		for _, r := range rules {
+			for _, pattern := range []string{r.CommonName, r.DNSName, r.URI, r.OU, r.Issuer} {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("bad pattern %q: %v", pattern, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Authorize returns an error telling why the client with cert is denied, or
+// nil if it is allowed. The certificate must have been verified, and is nil
+// if the client sent none.
+func (p *CertPolicy) Authorize(cert *x509.Certificate) error {
+	if cert == nil {
+		if len(p.Allow) > 0 {
+			return errors.New("no client certificate")
+		}
+		return nil
+	}
+	for i, r := range p.Deny {
+		if r.Match(cert) {
+			return fmt.Errorf("%s denied by rule %d (%s)", cert.Subject, i, r)
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for _, r := range p.Allow {
+		if r.Match(cert) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s matches no allow rule", cert.Subject)
+}
+
+// Match reports whether the rule matches cert.
+func (r CertRule) Match(cert *x509.Certificate) bool {
+	var uris []string
+	for _, u := range cert.URIs {
+		uris = append(uris, u.String())
+	}
+	return matchAny(r.CommonName, cert.Subject.CommonName) &&
+		matchAny(r.DNSName, cert.DNSNames...) &&
+		matchAny(r.URI, uris...) &&
+		matchAny(r.OU, cert.Subject.OrganizationalUnit...) &&
+		matchAny(r.Issuer, cert.Issuer.CommonName, cert.Issuer.String())
+}
+
+func (r CertRule) String() string {
+	var fields []string
+	for _, f := range []struct{ name, pattern string }{
+		{"cn", r.CommonName},
+		{"dns", r.DNSName},
+		{"uri", r.URI},
+		{"ou", r.OU},
+		{"issuer", r.Issuer},
+	} {
+		if f.pattern != "" {
+			fields = append(fields, f.name+"="+f.pattern)
+		}
+	}
+	if len(fields) == 0 {
+		return "any"
+	}
+	return strings.Join(fields, " ")
+}
+
+// matchAny reports whether pattern is empty or matches any of values.
+func matchAny(pattern string, values ...string) bool {
+	if pattern == "" {
+		return true
+	}
+	for _, v := range values {
+		if ok, _ := path.Match(pattern, v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// certPolicies returns all the policies of the proxy.
+func (rp *RProxy) certPolicies() []*CertPolicy {
+	var policies []*CertPolicy
+	if rp.certPolicy != nil {
+		policies = append(policies, rp.certPolicy)
+	}
+	for _, route := range rp.sniRoutes {
+		if route.CertPolicy != nil {
+			policies = append(policies, route.CertPolicy)
+		}
+	}
+	return policies
+}
+
+// authorize checks the client certificate of a TLS connection against the
+// policy of its SNI route, or else of the listener. A certificate the
+// handshake did not verify is denied.
+func (rp *RProxy) authorize(conn *tls.Conn) error {
+	cs := conn.ConnectionState()
+	policy := rp.certPolicy
+	if route := rp.matchSNI(cs.ServerName); route != nil && route.CertPolicy != nil {
+		policy = route.CertPolicy
+	}
+	if policy == nil {
+		return nil
+	}
+	var cert *x509.Certificate
+	if len(cs.PeerCertificates) > 0 {
+		// The rules are meant for verified certificates, which cannot
+		// be spoofed
+		if !verifiedClient(cs) {
+			return fmt.Errorf("%s not verified", cs.PeerCertificates[0].Subject)
+		}
+		cert = cs.PeerCertificates[0]
+	}
+	return policy.Authorize(cert)
+}
@@ -0,0 +1,133 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net/url"
+	"testing"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+func TestCertPolicyAuthorize(t *testing.T) {
+	uri, _ := url.Parse("spiffe://example.com/team-a/api")
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "api.team-a.example.com", OrganizationalUnit: []string{"team-a"}},
+		Issuer:   pkix.Name{CommonName: "Example CA", Organization: []string{"Example"}},
+		DNSNames: []string{"api.team-a.example.com"},
+		URIs:     []*url.URL{uri},
+	}
+	tests := []struct {
+		policy CertPolicy
+		allow  bool
+	}{
+		{CertPolicy{}, true},
+		{CertPolicy{Allow: []CertRule{{CommonName: "*.team-a.example.com"}}}, true},
+		{CertPolicy{Allow: []CertRule{{CommonName: "*.team-b.example.com"}}}, false},
+		{CertPolicy{Allow: []CertRule{{URI: "spiffe://example.com/team-a/*"}}}, true},
+		{CertPolicy{Allow: []CertRule{{URI: "spiffe://example.com/*"}}}, false},
+		{CertPolicy{Allow: []CertRule{{DNSName: "api.*.example.com", OU: "team-b"}}}, false},
+		{CertPolicy{Allow: []CertRule{{OU: "team-b"}, {OU: "team-a"}}}, true},
+		{CertPolicy{Allow: []CertRule{{Issuer: "Example CA"}}}, true},
+		{CertPolicy{Allow: []CertRule{{Issuer: "CN=Example CA,O=Example"}}}, true},
+		{CertPolicy{Allow: []CertRule{{Issuer: "Other CA"}}}, false},
+		{CertPolicy{Allow: []CertRule{{}}, Deny: []CertRule{{OU: "team-a"}}}, false},
+		{CertPolicy{Deny: []CertRule{{OU: "team-b"}}}, true},
+	}
+	for i, tt := range tests {
+		err := tt.policy.Authorize(cert)
+		if (err == nil) != tt.allow {
+			t.Errorf("%d: got %v, want allowed %v", i, err, tt.allow)
+		}
+	}
+	if err := (&CertPolicy{Allow: []CertRule{{}}}).Authorize(nil); err == nil {
+		t.Errorf("allowed a client without certificate")
+	}
+	if err := (&CertPolicy{Deny: []CertRule{{CommonName: "["}}}).Validate(); err == nil {
+		t.Errorf("accepted a bad pattern")
+	}
+}
+
+func TestCertPolicyRoute(t *testing.T) {
+	pki := newTestPKI(t)
+	rp := NewRProxyWithoutCerts("tls", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Banner("default")))
+	config := pki.serverConfig("default.test")
+	rp.SetServerConfig(config)
+	rp.SetCertPolicy(&CertPolicy{Allow: []CertRule{{CommonName: "team-a-*"}}})
+	rp.AddSNIRoute(&SNIRoute{
+		ServerName: "b.test",
+		Pool:       NewPool(nil, NewBackend("tcp", backendtest.Start(t, nil, backendtest.Banner("b")))),
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert := pki.issue(&x509.Certificate{Subject: pkix.Name{CommonName: "b.test"}, DNSNames: []string{"b.test"}})
+			return &cert, nil
+		},
+		CertPolicy: &CertPolicy{Allow: []CertRule{{CommonName: "team-b-*"}}},
+	})
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	tests := []struct {
+		client, serverName string
+		want               string
+	}{
+		{"team-a-alice", "default.test", "default"},
+		{"team-b-bob", "default.test", ""},
+		{"team-b-bob", "b.test", "b"},
+		{"team-a-alice", "b.test", ""},
+	}
+	for _, tt := range tests {
+		conn, err := tls.Dial("tcp", addr, pki.clientConfig(tt.client, tt.serverName))
+		if err != nil {
+			t.Errorf("%s to %s: dial error: %v", tt.client, tt.serverName, err)
+			continue
+		}
+		got, _ := io.ReadAll(conn)
+		conn.Close()
+		if string(got) != tt.want {
+			t.Errorf("%s to %s: got %q, want %q", tt.client, tt.serverName, got, tt.want)
+		}
+	}
+}
+
+func TestCertPolicyUnverified(t *testing.T) {
+	pki := newTestPKI(t)
+	config := pki.serverConfig("default.test")
+	// The client certificate is asked for but not verified
+	config.ClientAuth = tls.RequireAnyClientCert
+	rp := NewRProxyWithoutCerts("tls", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Banner("default")))
+	rp.SetServerConfig(config)
+	rp.SetCertPolicy(&CertPolicy{Allow: []CertRule{{CommonName: "team-a-*", Issuer: "testapp-root"}}})
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	// A certificate of another CA with the same names is spoofed
+	client := newTestPKI(t).clientConfig("team-a-mallory", "default.test")
+	client.RootCAs = pki.pool
+	conn, err := tls.Dial("tcp", addr, client)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	got, _ := io.ReadAll(conn)
+	conn.Close()
+	if len(got) != 0 {
+		t.Errorf("unverified certificate: got %q, want denied", got)
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errNoProxyHeader is returned when a trusted source does not start its
+// connection with a PROXY protocol header.
+var errNoProxyHeader = errors.New("no PROXY protocol header")
+
+// maxProxyHeaderV1 is the longest version 1 header, including CRLF.
+const maxProxyHeaderV1 = 107
+
+// proxyV2Signature starts every PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol version 2 commands and address families.
+const (
+	proxyV2Local = 0x20
+	proxyV2Proxy = 0x21
+	proxyV2TCP4  = 0x11
+	proxyV2TCP6  = 0x21
+)
+
+// SetProxyProtocol makes the proxy send a HAProxy PROXY protocol header of
+// version 1 or 2 to the backends, carrying the address of the client and the
+// address it connected to. Version 2 headers also carry TLVs describing the
+// TLS session and the verified client certificate, if any. Version 0, the
+// default, sends no header.
+func (rp *RProxy) SetProxyProtocol(version int) {
+	rp.proxyProtocol = version
+}
+
+// tcpAddrs returns the IP addresses and ports of src and dst, both as IPv4
+// if possible, or ok false if either is not a TCP address.
+func tcpAddrs(src, dst net.Addr) (srcIP, dstIP net.IP, srcPort, dstPort int, ok bool) {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 || s.IP == nil || d.IP == nil {
+		return nil, nil, 0, 0, false
+	}
+	srcIP, dstIP = s.IP.To4(), d.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = s.IP.To16(), d.IP.To16()
+	}
+	return srcIP, dstIP, s.Port, d.Port, true
+}
+
+// proxyHeaderV1 returns the version 1 header for a connection from src to
+// dst.
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	srcIP, dstIP, srcPort, dstPort, ok := tcpAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP4"
+	if srcIP.To4() == nil {
+		family = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcPort, dstPort))
+}
+
+// proxyHeaderV2 returns the version 2 header for a connection from src to
+// dst, followed by tlvs. Without addresses, a LOCAL header is returned, as
+// used by health checks.
+func proxyHeaderV2(src, dst net.Addr, tlvs []byte) []byte {
+	var addrs bytes.Buffer
+	command, family := byte(proxyV2Local), byte(0)
+	if srcIP, dstIP, srcPort, dstPort, ok := tcpAddrs(src, dst); ok {
+		command, family = proxyV2Proxy, proxyV2TCP4
+		if len(srcIP) == net.IPv6len {
+			family = proxyV2TCP6
+		}
+		addrs.Write(srcIP)
+		addrs.Write(dstIP)
+		binary.Write(&addrs, binary.BigEndian, uint16(srcPort))
+		binary.Write(&addrs, binary.BigEndian, uint16(dstPort))
+	}
+	addrs.Write(tlvs)
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(addrs.Len()))
+	return append(header, addrs.Bytes()...)
+}
+
+// proxyHeader returns the PROXY protocol header to send to the backend for
+// conn, or nil if none is configured.
+func (rp *RProxy) proxyHeader(conn net.Conn) []byte {
+	switch rp.proxyProtocol {
+	case 1:
+		return proxyHeaderV1(conn.RemoteAddr(), conn.LocalAddr())
+	case 2:
+		return proxyHeaderV2(conn.RemoteAddr(), conn.LocalAddr(), proxyTLVs(conn))
+	default:
+		return nil
+	}
+}
+
+// localProxyHeader returns the PROXY protocol header sent by health checks,
+// which carries no client, or nil if none is configured.
+func (rp *RProxy) localProxyHeader() []byte {
+	switch rp.proxyProtocol {
+	case 1:
+		return []byte("PROXY UNKNOWN\r\n")
+	case 2:
+		return proxyHeaderV2(nil, nil, nil)
+	default:
+		return nil
+	}
+}
+
+// SetAcceptProxyProtocol makes the listener read a PROXY protocol header of
+// version 1 or 2 from the connections of the trusted networks, before any TLS
+// handshake, and use the client address it carries for balancing, logging,
+// and any header sent to the backends. Connections from other sources are
+// served with their own address. It must be called before Start.
+func (rp *RProxy) SetAcceptProxyProtocol(trusted []*net.IPNet) {
+	rp.trustedProxies = trusted
+}
+
+// acceptProxyHeader reads the PROXY protocol header of a connection from a
+// trusted source within the handshake timeout, and returns the connection
+// with the addresses of the header.
+func (rp *RProxy) acceptProxyHeader(conn net.Conn) (net.Conn, error) {
+	if !containsAddr(rp.trustedProxies, conn.RemoteAddr()) {
+		return conn, nil
+	}
+	if rp.handshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(rp.handshakeTimeout))
+	}
+	r := bufio.NewReader(conn)
+	src, dst, err := readProxyHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return newProxiedConn(conn, r, src, dst), nil
+}
+
+// readProxyHeader reads a version 1 or 2 header from r. The addresses are nil
+// if the header carries none, such as for health checks of the load balancer.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case bytes.Equal(sig, proxyV2Signature):
+		return readProxyHeaderV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return readProxyHeaderV1(r)
+	default:
+		return nil, nil, errNoProxyHeader
+	}
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil && err != bufio.ErrBufferFull {
+		return nil, nil, err
+	}
+	if len(line) > maxProxyHeaderV1 {
+		return nil, nil, errors.New("PROXY v1 header too long")
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	srcAddr, err1 := parseProxyAddrV1(fields[1], fields[2], fields[4])
+	dstAddr, err2 := parseProxyAddrV1(fields[1], fields[3], fields[5])
+	if err1 != nil || err2 != nil {
+		return nil, nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	return srcAddr, dstAddr, nil
+}
+
+func parseProxyAddrV1(family, ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (addr.To4() != nil) != (family == "TCP4") {
+		return nil, errors.New("bad address")
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]&0xf0 != 0x20 {
+		return nil, nil, fmt.Errorf("PROXY v2 header version %d not supported", header[12]>>4)
+	}
+	command, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	switch command {
+	case proxyV2Local:
+		return nil, nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("PROXY v2 command %#x not supported", command)
+	}
+	// Only TCP addresses are used; the TLVs following them are skipped
+	switch {
+	case family == proxyV2TCP4 && len(body) >= 12:
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))},
+			&net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:]))}, nil
+	case family == proxyV2TCP6 && len(body) >= 36:
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))},
+			&net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:]))}, nil
+	case family == proxyV2TCP4 || family == proxyV2TCP6:
+		return nil, nil, errors.New("PROXY v2 header too short")
+	default:
+		return nil, nil, nil
+	}
+}
+
+// proxiedConn is a client connection relayed by a trusted proxy, with the
+// addresses of its PROXY protocol header.
+type proxiedConn struct {
+	net.Conn
+	r             io.Reader
+	remote, local net.Addr
+}
+
+func newProxiedConn(conn net.Conn, r io.Reader, remote, local net.Addr) *proxiedConn {
+	if remote == nil || local == nil {
+		remote, local = conn.RemoteAddr(), conn.LocalAddr()
+	}
+	return &proxiedConn{Conn: conn, r: r, remote: remote, local: local}
+}
+
+// Read reads the data buffered after the header, then the connection.
+func (c *proxiedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the address of the client.
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// LocalAddr returns the address the client connected to.
+func (c *proxiedConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// CloseWrite shuts down the writing side of the connection.
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
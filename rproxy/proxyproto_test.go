@@ -0,0 +1,147 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+func TestProxyHeader(t *testing.T) {
+	v4 := func(ip string, port int) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: port} }
+	tests := []struct {
+		version  int
+		src, dst net.Addr
+		want     []byte
+	}{
+		{1, v4("192.0.2.1", 5000), v4("198.51.100.2", 443), []byte("PROXY TCP4 192.0.2.1 198.51.100.2 5000 443\r\n")},
+		{1, v4("2001:db8::1", 5000), v4("2001:db8::2", 443), []byte("PROXY TCP6 2001:db8::1 2001:db8::2 5000 443\r\n")},
+		{1, &net.UnixAddr{Name: "a", Net: "unix"}, v4("2001:db8::2", 443), []byte("PROXY UNKNOWN\r\n")},
+		{2, v4("192.0.2.1", 5000), v4("198.51.100.2", 443), append(append([]byte{}, proxyV2Signature...),
+			0x21, 0x11, 0, 12, 192, 0, 2, 1, 198, 51, 100, 2, 0x13, 0x88, 0x01, 0xbb)},
+		{2, nil, nil, append(append([]byte{}, proxyV2Signature...), 0x20, 0, 0, 0)},
+	}
+	for _, tt := range tests {
+		var got []byte
+		if tt.version == 1 {
+			got = proxyHeaderV1(tt.src, tt.dst)
+		} else {
+			got = proxyHeaderV2(tt.src, tt.dst, nil)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("v%d %v -> %v: got %q, want %q", tt.version, tt.src, tt.dst, got, tt.want)
+		}
+	}
+	// Mixed families are sent as IPv6
+	got := proxyHeaderV2(v4("192.0.2.1", 1), v4("2001:db8::2", 2), nil)
+	if got[13] != proxyV2TCP6 || len(got) != 16+36 {
+		t.Errorf("mixed families: got %q", got)
+	}
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	lines := make(chan string, 1)
+	backend := backendtest.Start(t, nil, readLine(lines))
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", backend)
+	rp.SetProxyProtocol(1)
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.TCPAddr)
+	remote := conn.RemoteAddr().(*net.TCPAddr)
+	want := string(proxyHeaderV1(local, remote))
+	if got := <-lines; got != want {
+		t.Errorf("got header %q, want %q", got, want)
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}
+	dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	tlvs := appendTLV(nil, PP2TypeAuthority, []byte("a.example.com"))
+	tests := []struct {
+		input    string
+		src, dst net.Addr
+		err      bool
+	}{
+		{string(proxyHeaderV1(src, dst)), src, dst, false},
+		{string(proxyHeaderV2(src, dst, tlvs)), src, dst, false},
+		{string(proxyHeaderV2(nil, nil, nil)), nil, nil, false},
+		{"PROXY UNKNOWN 1 2 3 4\r\n", nil, nil, false},
+		{"PROXY TCP4 2001:db8::1 192.0.2.1 1 2\r\n", nil, nil, true},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 1 70000\r\n", nil, nil, true},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 1 2\n", nil, nil, true},
+		{"\x16\x03\x01\x00\x05hello, world", nil, nil, true},
+	}
+	for _, tt := range tests {
+		r := bufio.NewReader(bytes.NewReader(append([]byte(tt.input), "data"...)))
+		gotSrc, gotDst, err := readProxyHeader(r)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: got no error", tt.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: error: %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(gotSrc, tt.src) || !reflect.DeepEqual(gotDst, tt.dst) {
+			t.Errorf("%q: got %v -> %v, want %v -> %v", tt.input, gotSrc, gotDst, tt.src, tt.dst)
+		}
+		if rest, _ := r.ReadString(0); rest != "data" {
+			t.Errorf("%q: left %q after the header", tt.input, rest)
+		}
+	}
+}
+
+func TestAcceptProxyProtocol(t *testing.T) {
+	lines := make(chan string, 1)
+	backend := backendtest.Start(t, nil, readLine(lines))
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", backend)
+	trusted, err := ParseCIDRs([]string{"192.0.2.0/24", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("ParseCIDRs error: %v", err)
+	}
+	rp.SetAcceptProxyProtocol(trusted)
+	rp.SetProxyProtocol(1)
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	src := &net.TCPAddr{IP: net.ParseIP("198.51.100.7").To4(), Port: 5000}
+	dst := &net.TCPAddr{IP: net.ParseIP("203.0.113.1").To4(), Port: 443}
+	conn.Write(proxyHeaderV2(src, dst, nil))
+	want := "PROXY TCP4 198.51.100.7 203.0.113.1 5000 443\r\n"
+	if got := <-lines; got != want {
+		t.Errorf("got header %q, want %q", got, want)
+	}
+}
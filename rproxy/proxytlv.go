@@ -0,0 +1,168 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"net"
+)
+
+// PROXY protocol version 2 TLV types sent to the backends. The standard types
+// carry the ALPN protocol, the SNI server name, and the TLS session. The
+// verified client certificate is described by the TLS subtypes and by custom
+// types in the range reserved for applications.
+const (
+	PP2TypeALPN      = 0x01 // negotiated application protocol
+	PP2TypeAuthority = 0x02 // SNI server name
+	PP2TypeSSL       = 0x20 // TLS session, with the subtypes below
+
+	PP2SubtypeSSLVersion = 0x21 // such as TLSv1.3
+	PP2SubtypeSSLCN      = 0x22 // client certificate common name
+	PP2SubtypeSSLCipher  = 0x23 // cipher suite
+	PP2SubtypeSSLSigAlg  = 0x24 // client certificate signature algorithm
+	PP2SubtypeSSLKeyAlg  = 0x25 // client certificate key algorithm
+
+	PP2TypeSSLSubject     = 0xe0 // client certificate subject, RFC 2253 form
+	PP2TypeSSLSAN         = 0xe1 // one per SAN, such as DNS:a.example.com
+	PP2TypeSSLFingerprint = 0xe2 // SHA-256 of the client certificate
+)
+
+// Client flags of the PP2TypeSSL value.
+const (
+	PP2ClientSSL      = 0x01 // the client connected over TLS
+	PP2ClientCertConn = 0x02 // the client presented a certificate on the connection
+	PP2ClientCertSess = 0x04 // the client presented a certificate on the session
+)
+
+// appendTLV appends a TLV of type typ to b.
+func appendTLV(b []byte, typ byte, value []byte) []byte {
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+// proxyTLVs returns the TLVs describing the TLS session of a client
+// connection, or nil if it has none.
+func proxyTLVs(conn net.Conn) []byte {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		return tlsTLVs(c.ConnectionState())
+	case *peekedConn:
+		// The TLS session goes through to the backend untouched
+		if c.hello.serverName != "" {
+			return appendTLV(nil, PP2TypeAuthority, []byte(c.hello.serverName))
+		}
+	}
+	return nil
+}
+
+// tlsTLVs returns the TLVs describing a TLS session terminated by the proxy.
+// The client certificate, if any, is reported verified only if the handshake
+// verified it.
+func tlsTLVs(cs tls.ConnectionState) []byte {
+	var tlvs []byte
+	if cs.NegotiatedProtocol != "" {
+		tlvs = appendTLV(tlvs, PP2TypeALPN, []byte(cs.NegotiatedProtocol))
+	}
+	if cs.ServerName != "" {
+		tlvs = appendTLV(tlvs, PP2TypeAuthority, []byte(cs.ServerName))
+	}
+
+	var cert *x509.Certificate
+	if len(cs.PeerCertificates) > 0 {
+		cert = cs.PeerCertificates[0]
+	}
+	client, verify := byte(PP2ClientSSL), uint32(1)
+	if cert != nil {
+		if verifiedClient(cs) {
+			verify = 0
+		}
+		if cs.DidResume {
+			client |= PP2ClientCertSess
+		} else {
+			client |= PP2ClientCertConn
+		}
+	}
+	ssl := []byte{client}
+	ssl = binary.BigEndian.AppendUint32(ssl, verify)
+	ssl = appendTLV(ssl, PP2SubtypeSSLVersion, []byte(tlsVersionName(cs.Version)))
+	ssl = appendTLV(ssl, PP2SubtypeSSLCipher, []byte(tls.CipherSuiteName(cs.CipherSuite)))
+	if cert != nil {
+		if cert.Subject.CommonName != "" {
+			ssl = appendTLV(ssl, PP2SubtypeSSLCN, []byte(cert.Subject.CommonName))
+		}
+		ssl = appendTLV(ssl, PP2SubtypeSSLSigAlg, []byte(cert.SignatureAlgorithm.String()))
+		ssl = appendTLV(ssl, PP2SubtypeSSLKeyAlg, []byte(cert.PublicKeyAlgorithm.String()))
+	}
+	tlvs = appendTLV(tlvs, PP2TypeSSL, ssl)
+
+	if cert != nil {
+		tlvs = appendTLV(tlvs, PP2TypeSSLSubject, []byte(cert.Subject.String()))
+		for _, san := range certSANs(cert) {
+			tlvs = appendTLV(tlvs, PP2TypeSSLSAN, []byte(san))
+		}
+		fingerprint := sha256.Sum256(cert.Raw)
+		tlvs = appendTLV(tlvs, PP2TypeSSLFingerprint, fingerprint[:])
+	}
+	return tlvs
+}
+
+// verifiedClient reports whether the handshake verified the client
+// certificate, rather than only asking for one. Certificates checked only by
+// the VerifyConnection or VerifyPeerCertificate of a config are not reported
+// verified, as those may check anything.
+func verifiedClient(cs tls.ConnectionState) bool {
+	return len(cs.PeerCertificates) > 0 && len(cs.VerifiedChains) > 0
+}
+
+// certSANs returns the subject alternative names of cert, each prefixed by
+// its kind as in DNS:a.example.com or URI:spiffe://example.com/a.
+func certSANs(cert *x509.Certificate) []string {
+	var sans []string
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI:"+uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	return sans
+}
+
+// tlsVersionName returns the name of a TLS version as used by OpenSSL.
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	default:
+		return tls.VersionName(version)
+	}
+}
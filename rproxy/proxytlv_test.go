@@ -0,0 +1,187 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-rproxy/certs"
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+// parseTLVs returns the values of a list of TLVs by type.
+func parseTLVs(t *testing.T, b []byte) map[byte][][]byte {
+	tlvs := make(map[byte][][]byte)
+	for len(b) > 0 {
+		if len(b) < 3 || len(b) < 3+int(binary.BigEndian.Uint16(b[1:])) {
+			t.Fatalf("truncated TLV %q", b)
+		}
+		n := 3 + int(binary.BigEndian.Uint16(b[1:]))
+		tlvs[b[0]] = append(tlvs[b[0]], b[3:n])
+		b = b[n:]
+	}
+	return tlvs
+}
+
+func TestProxyTLVs(t *testing.T) {
+	headers := make(chan []byte, 1)
+	backend := backendtest.Start(t, nil, sendProxyHeaderV2(headers))
+
+	pki := newTestPKI(t)
+	rp := NewRProxyWithoutCerts("tls", "127.0.0.1:0", "tcp", backend)
+	rp.SetServerConfig(pki.serverConfig("proxy.test"))
+	rp.SetNextProtos([]string{"h2"})
+	rp.SetProxyProtocol(2)
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	uri, _ := url.Parse("spiffe://example.com/alice")
+	cert := pki.issue(&x509.Certificate{
+		Subject:  pkix.Name{CommonName: "alice", Organization: []string{"Example"}},
+		DNSNames: []string{"alice.example.com"},
+		URIs:     []*url.URL{uri},
+	})
+	config := pki.clientConfig("unused", "proxy.test")
+	config.Certificates = []tls.Certificate{cert}
+	config.NextProtos = []string{"h2"}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+
+	header := <-headers
+	src, dst, err := readProxyHeader(bufio.NewReader(bytes.NewReader(header)))
+	if err != nil || src.String() != conn.LocalAddr().String() || dst.String() != conn.RemoteAddr().String() {
+		t.Errorf("got %v -> %v, %v", src, dst, err)
+	}
+	tlvs := parseTLVs(t, header[16+12:])
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+	want := map[byte][]string{
+		PP2TypeALPN:           {"h2"},
+		PP2TypeAuthority:      {"proxy.test"},
+		PP2TypeSSLSubject:     {"CN=alice,O=Example"},
+		PP2TypeSSLSAN:         {"DNS:alice.example.com", "URI:spiffe://example.com/alice"},
+		PP2TypeSSLFingerprint: {string(fingerprint[:])},
+	}
+	for typ, values := range want {
+		if len(tlvs[typ]) != len(values) {
+			t.Errorf("TLV %#x: got %q, want %q", typ, tlvs[typ], values)
+			continue
+		}
+		for i, v := range values {
+			if string(tlvs[typ][i]) != v {
+				t.Errorf("TLV %#x: got %q, want %q", typ, tlvs[typ][i], v)
+			}
+		}
+	}
+
+	if len(tlvs[PP2TypeSSL]) != 1 || len(tlvs[PP2TypeSSL][0]) < 5 {
+		t.Fatalf("TLS TLV: got %q", tlvs[PP2TypeSSL])
+	}
+	ssl := tlvs[PP2TypeSSL][0]
+	if ssl[0] != PP2ClientSSL|PP2ClientCertConn || binary.BigEndian.Uint32(ssl[1:]) != 0 {
+		t.Errorf("TLS TLV: got client %#x, verify %d", ssl[0], binary.BigEndian.Uint32(ssl[1:]))
+	}
+	sub := parseTLVs(t, ssl[5:])
+	if got := string(sub[PP2SubtypeSSLCN][0]); got != "alice" {
+		t.Errorf("common name: got %q", got)
+	}
+	if got := string(sub[PP2SubtypeSSLVersion][0]); got != "TLSv1.3" {
+		t.Errorf("version: got %q", got)
+	}
+}
+
+func TestProxyTLVsUnverified(t *testing.T) {
+	pki := newTestPKI(t)
+	cert, err := x509.ParseCertificate(pki.issue(&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}).Certificate[0])
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	cs := tls.ConnectionState{Version: tls.VersionTLS13, PeerCertificates: []*x509.Certificate{cert}}
+	for _, test := range []struct {
+		chains [][]*x509.Certificate
+		verify uint32
+	}{
+		{nil, 1},
+		{[][]*x509.Certificate{{cert}}, 0},
+	} {
+		cs.VerifiedChains = test.chains
+		ssl := parseTLVs(t, tlsTLVs(cs))[PP2TypeSSL][0]
+		if ssl[0] != PP2ClientSSL|PP2ClientCertConn {
+			t.Errorf("got client %#x", ssl[0])
+		}
+		if got := binary.BigEndian.Uint32(ssl[1:]); got != test.verify {
+			t.Errorf("%d chains: got verify %d, want %d", len(test.chains), got, test.verify)
+		}
+	}
+}
+
+func TestProxyTLVsReloadingCerts(t *testing.T) {
+	headers := make(chan []byte, 1)
+	backend := backendtest.Start(t, nil, sendProxyHeaderV2(headers))
+
+	pki := newTestPKI(t)
+	root, cert, key := pki.writeFiles(t.TempDir(), "proxy.test")
+	config, err := certs.LoadReloadingServerCerts(root, cert, key, time.Hour)
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+	rp := NewRProxyWithoutCerts("tls", "127.0.0.1:0", "tcp", backend)
+	rp.SetServerConfig(config)
+	rp.SetNextProtos([]string{"h2"})
+	rp.SetProxyProtocol(2)
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	// A client of another CA fails the handshake
+	client := newTestPKI(t).clientConfig("mallory", "proxy.test")
+	client.RootCAs = pki.pool
+	if conn, err := tls.Dial("tcp", addr, client); err == nil {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil || err == io.EOF {
+			t.Errorf("client of another CA: got %v, want a handshake error", err)
+		}
+		conn.Close()
+	}
+
+	client = pki.clientConfig("alice", "proxy.test")
+	client.NextProtos = []string{"h2"}
+	conn, err := tls.Dial("tcp", addr, client)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	tlvs := parseTLVs(t, (<-headers)[16+12:])
+	if got := string(tlvs[PP2TypeALPN][0]); got != "h2" {
+		t.Errorf("ALPN: got %q, want h2", got)
+	}
+	ssl := tlvs[PP2TypeSSL][0]
+	if ssl[0] != PP2ClientSSL|PP2ClientCertConn || binary.BigEndian.Uint32(ssl[1:]) != 0 {
+		t.Errorf("TLS TLV: got client %#x, verify %d, want a verified certificate", ssl[0], binary.BigEndian.Uint32(ssl[1:]))
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Keys of rate limits.
+const (
+	RateLimitGlobal = "global" // one limit for all the clients
+	RateLimitIP     = "ip"     // a limit per client IP address
+	RateLimitCert   = "cert"   // a limit per client certificate subject
+)
+
+// Policies of rate limits.
+const (
+	RateLimitReject = "reject" // close the connections over the limit
+	RateLimitDelay  = "delay"  // hold them until the limit allows them
+)
+
+// DefaultRateLimitMaxDelay is the longest a connection is held by the delay
+// policy if the limit does not set it.
+const DefaultRateLimitMaxDelay = 5 * time.Second
+
+// RateLimit limits the rate of new connections with a token bucket: Burst
+// connections are allowed at once, refilled at Rate per second.
+type RateLimit struct {
+	Rate  float64 // connections per second
+	Burst int     // at least 1
+	// Key is global, ip, or cert. Limits by ip are checked before any TLS
+	// handshake; limits by cert require a tls listener and are checked
+	// after it, with clients sending no certificate limited by IP.
+	Key string
+	// Policy is reject or delay. With delay, connections over the limit
+	// wait for their turn, and are rejected if it is more than MaxDelay
+	// away.
+	Policy   string
+	MaxDelay time.Duration
+}
+
+// SetRateLimit sets the limit on the rate of new connections. It must be
+// called before Start.
+func (rp *RProxy) SetRateLimit(rl *RateLimit) {
+	rp.rateLimit = rl
+}
+
+// RateLimitedConns returns the number of connections rejected by the rate
+// limit.
+func (rp *RProxy) RateLimitedConns() int64 {
+	return atomic.LoadInt64(&rp.rateLimited)
+}
+
+// validate checks the settings of the rate limit.
+func (rl *RateLimit) validate() error {
+	if rl.Rate <= 0 || rl.Burst < 1 {
+		return errors.New("rate limit requires a positive rate and burst")
+	}
+	switch rl.Key {
+	case RateLimitGlobal, RateLimitIP, RateLimitCert:
+	default:
+		return fmt.Errorf("rate limit key %q not supported", rl.Key)
+	}
+	switch rl.Policy {
+	case RateLimitReject, RateLimitDelay:
+	default:
+		return fmt.Errorf("rate limit policy %q not supported", rl.Policy)
+	}
+	return nil
+}
+
+// limitRate checks a client connection against the rate limit, if its key is
+// known at this stage, waiting for its turn under the delay policy. The
+// connection is closed if it is rejected, or if the connections are closed
+// while it waits.
+func (rp *RProxy) limitRate(conn net.Conn) bool {
+	rl := rp.rateLimit
+	if rl == nil {
+		return true
+	}
+	var key string
+	switch rl.Key {
+	case RateLimitGlobal:
+	case RateLimitIP:
+		key = clientIP(conn.RemoteAddr())
+	case RateLimitCert:
+		if _, ok := conn.(*tls.Conn); !ok {
+			return true // not handshaken yet
+		}
+		key = clientIdentity(conn)
+	}
+	maxDelay := time.Duration(0)
+	if rl.Policy == RateLimitDelay {
+		maxDelay = rl.MaxDelay
+		if maxDelay <= 0 {
+			maxDelay = DefaultRateLimitMaxDelay
+		}
+	}
+	wait, ok := rp.buckets.reserve(key, 1, time.Now(), maxDelay)
+	if !ok {
+		atomic.AddInt64(&rp.rateLimited, 1)
+		rp.logf("rate limit: %v rejected", conn.RemoteAddr())
+		conn.Close()
+		return false
+	}
+	if wait > 0 && !rp.sleep(wait) {
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+// clientIdentity returns the subject of the client certificate of a TLS
+// connection, or else the client IP address.
+func clientIdentity(conn net.Conn) string {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			return "cert:" + certs[0].Subject.String()
+		}
+	}
+	return "ip:" + clientIP(conn.RemoteAddr())
+}
+
+// tokenBuckets holds a token bucket per key.
+type tokenBuckets struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBuckets(rate float64, burst int) *tokenBuckets {
+	return &tokenBuckets{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// reserve takes n tokens from the bucket of key at now, and returns how long
+// to wait before they are due. If that is longer than maxWait, no token is
+// taken and ok is false.
+func (tb *tokenBuckets) reserve(key string, n float64, now time.Time, maxWait time.Duration) (wait time.Duration, ok bool) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.sweep(now)
+	b, found := tb.buckets[key]
+	if !found {
+		b = &tokenBucket{tokens: tb.burst, last: now}
+		tb.buckets[key] = b
+	}
+	tb.refill(b, now)
+	if b.tokens < n {
+		wait = time.Duration((n - b.tokens) / tb.rate * float64(time.Second))
+		if wait > maxWait {
+			return 0, false
+		}
+	}
+	b.tokens -= n
+	return wait, true
+}
+
+func (tb *tokenBuckets) refill(b *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * tb.rate
+		if b.tokens > tb.burst {
+			b.tokens = tb.burst
+		}
+		b.last = now
+	}
+}
+
+// sweep forgets the full buckets once a minute, as they are the same as new
+// ones.
+func (tb *tokenBuckets) sweep(now time.Time) {
+	if now.Sub(tb.lastSweep) < time.Minute {
+		return
+	}
+	tb.lastSweep = now
+	for key, b := range tb.buckets {
+		tb.refill(b, now)
+		if b.tokens >= tb.burst {
+			delete(tb.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+func TestTokenBuckets(t *testing.T) {
+	tb := newTokenBuckets(2, 3)
+	now := time.Now()
+	// The burst is allowed at once, per key
+	for i := 0; i < 3; i++ {
+		if wait, ok := tb.reserve("a", 1, now, 0); !ok || wait != 0 {
+			t.Fatalf("burst %d: got %v, %v", i, wait, ok)
+		}
+	}
+	if _, ok := tb.reserve("a", 1, now, 0); ok {
+		t.Errorf("allowed over the burst")
+	}
+	if _, ok := tb.reserve("b", 1, now, 0); !ok {
+		t.Errorf("limited another key")
+	}
+	// Waiting is allowed up to maxWait, and queues behind earlier waits
+	if wait, ok := tb.reserve("a", 1, now, time.Second); !ok || wait != 500*time.Millisecond {
+		t.Errorf("got wait %v, %v, want 500ms", wait, ok)
+	}
+	if wait, ok := tb.reserve("a", 1, now, time.Second); !ok || wait != time.Second {
+		t.Errorf("got wait %v, %v, want 1s", wait, ok)
+	}
+	if _, ok := tb.reserve("a", 1, now, time.Second); ok {
+		t.Errorf("allowed a wait over maxWait")
+	}
+	// Tokens refill at the rate
+	if _, ok := tb.reserve("a", 1, now.Add(1500*time.Millisecond), 0); !ok {
+		t.Errorf("bucket not refilled")
+	}
+	// Full buckets are forgotten
+	tb.reserve("a", 1, now.Add(time.Hour), 0)
+	if len(tb.buckets) != 1 {
+		t.Errorf("got %d buckets after sweep, want 1", len(tb.buckets))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	for _, policy := range []string{RateLimitReject, RateLimitDelay} {
+		rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Banner("hello")))
+		rp.SetRateLimit(&RateLimit{Rate: 10, Burst: 2, Key: RateLimitIP, Policy: policy, MaxDelay: 150 * time.Millisecond})
+		addr, _ := startProxy(t, rp)
+
+		// Dial all the connections at once, then read them
+		var conns []net.Conn
+		for i := 0; i < 4; i++ {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("dial error: %v", err)
+			}
+			conns = append(conns, conn)
+		}
+		served := 0
+		for _, conn := range conns {
+			if b, _ := io.ReadAll(conn); string(b) == "hello" {
+				served++
+			}
+			conn.Close()
+		}
+		// Two connections of the burst, then under the delay policy one
+		// delayed by 100ms, while the one 200ms away is rejected
+		want := 2
+		if policy == RateLimitDelay {
+			want = 3
+		}
+		if served != want {
+			t.Errorf("%s: %d connections served, want %d", policy, served, want)
+		}
+		if n := rp.RateLimitedConns(); n != int64(4-want) {
+			t.Errorf("%s: %d connections rejected, want %d", policy, n, 4-want)
+		}
+		rp.Close()
+	}
+}
+
+func TestRateLimitDelayShutdown(t *testing.T) {
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Banner("hello")))
+	rp.SetRateLimit(&RateLimit{Rate: 0.01, Burst: 1, Key: RateLimitGlobal, Policy: RateLimitDelay, MaxDelay: time.Hour})
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer first.Close()
+	if b, err := io.ReadAll(first); string(b) != "hello" {
+		t.Fatalf("got %q, %v, want hello", b, err)
+	}
+
+	// The delayed connection is dropped when the shutdown times out, rather
+	// than holding it up until its turn
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- rp.Shutdown(ctx)
+	}()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("shutdown: got %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("shutdown waited for the delayed connection")
+	}
+	if b, err := io.ReadAll(conn); len(b) != 0 || err != nil {
+		t.Errorf("got %q, %v, want the connection closed", b, err)
+	}
+}
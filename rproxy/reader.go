@@ -19,12 +19,18 @@ package rproxy
 import (
 	"io"
 	"log"
+	"sync/atomic"
+	"time"
 )
 
 // RPReader defines a customized Reader, which is used to log data.
 type RPReader struct {
-	Reader  io.Reader
-	verbose bool
+	Reader    io.Reader
+	verbose   bool
+	logger    *log.Logger
+	throttles []throttle
+	cancel    <-chan struct{} // stops waiting for the throttles
+	activity  *int64          // time of the last read, in Unix nanoseconds
 }
 
 // NewRPReader creates the new RPReader from an io.Reader.
@@ -34,9 +40,24 @@ func NewRPReader(r io.Reader, v bool) io.Reader {
 
 // Read reads data from the reader.
 func (r *RPReader) Read(p []byte) (n int, err error) {
+	if len(r.throttles) > 0 {
+		if chunk := throttleChunk(r.throttles); len(p) > chunk {
+			p = p[:chunk]
+		}
+	}
 	n, err = r.Reader.Read(p)
+	if n > 0 && r.activity != nil {
+		atomic.StoreInt64(r.activity, time.Now().UnixNano())
+	}
+	if n > 0 && len(r.throttles) > 0 {
+		waitThrottles(r.throttles, n, r.cancel)
+	}
 	if r.verbose {
-		log.Print(string(p[:n]))
+		if r.logger != nil {
+			r.logger.Print(string(p[:n]))
+		} else {
+			log.Print(string(p[:n]))
+		}
 	}
 	return
 }
@@ -0,0 +1,108 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// DefaultDialTimeout is the time to connect to a backend if not set.
+const DefaultDialTimeout = 30 * time.Second
+
+// MaxRetries is the most retries a RetryPolicy may have.
+const MaxRetries = 100
+
+// RetryPolicy retries failed backend dials, before the client connection is
+// given up on. Each retry picks a backend again, so it may go to another one.
+type RetryPolicy struct {
+	Retries int // dials after the first
+	// Backoff is the wait before the first retry, doubled for each next one
+	// up to MaxBackoff, if set.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Jitter is the fraction of each wait, from 0 to 1, taken off at
+	// random, so that clients do not retry all at once.
+	Jitter float64
+}
+
+// SetDialTimeout sets the time to connect to a backend, DefaultDialTimeout
+// if not set.
+func (rp *RProxy) SetDialTimeout(d time.Duration) {
+	rp.dialTimeout = d
+}
+
+// SetBackendHandshakeTimeout sets the time for the TLS handshake with tls
+// backends, after connecting, DefaultHandshakeTimeout if not set. Zero means
+// no timeout.
+func (rp *RProxy) SetBackendHandshakeTimeout(d time.Duration) {
+	rp.backendHandshakeTimeout = d
+}
+
+// SetRetryPolicy sets the policy retrying failed backend dials. By default,
+// the client connection is closed when the dial fails.
+func (rp *RProxy) SetRetryPolicy(p *RetryPolicy) {
+	rp.retry = p
+}
+
+// validate checks the settings of the retry policy.
+func (p *RetryPolicy) validate() error {
+	if p.Retries < 0 || p.Backoff < 0 || p.MaxBackoff < 0 {
+		return errors.New("retry policy settings must not be negative")
+	}
+	if p.Retries > MaxRetries {
+		return fmt.Errorf("retries must be at most %d", MaxRetries)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return errors.New("retry jitter must be from 0 to 1")
+	}
+	return nil
+}
+
+// backoff returns the wait before retry number attempt, counting from 0, or
+// ok false if there are no retries left.
+func (p *RetryPolicy) backoff(attempt int) (wait time.Duration, ok bool) {
+	if p == nil || attempt >= p.Retries {
+		return 0, false
+	}
+	wait = p.Backoff
+	// Stop doubling before the wait overflows
+	for i := 0; i < attempt && (p.MaxBackoff <= 0 || wait < p.MaxBackoff) && wait <= math.MaxInt64/2; i++ {
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	wait -= time.Duration(rand.Float64() * p.Jitter * float64(wait))
+	return wait, true
+}
+
+// sleep waits for d, and reports false if the connections are closed in the
+// meantime.
+func (rp *RProxy) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-rp.drop:
+		return false
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+func TestBackoff(t *testing.T) {
+	p := &RetryPolicy{Retries: 5, Backoff: 100 * time.Millisecond, MaxBackoff: 500 * time.Millisecond}
+	want := []time.Duration{100, 200, 400, 500, 500}
+	for i, w := range want {
+		if got, ok := p.backoff(i); !ok || got != w*time.Millisecond {
+			t.Errorf("attempt %d: got %v, %v, want %v", i, got, ok, w*time.Millisecond)
+		}
+	}
+	if _, ok := p.backoff(5); ok {
+		t.Errorf("retried more than Retries")
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got, _ := p.backoff(0); got <= 50*time.Millisecond || got > 100*time.Millisecond {
+			t.Fatalf("got %v with jitter, want in (50ms, 100ms]", got)
+		}
+	}
+	// Without a maximum, the wait stops doubling before it overflows
+	p = &RetryPolicy{Retries: MaxRetries, Backoff: time.Second}
+	for i := 0; i < MaxRetries; i++ {
+		if got, ok := p.backoff(i); !ok || got < time.Second {
+			t.Fatalf("attempt %d: got %v, %v", i, got, ok)
+		}
+	}
+	if err := (&RetryPolicy{Retries: MaxRetries + 1}).validate(); err == nil {
+		t.Errorf("validated more than MaxRetries retries")
+	}
+	if _, ok := (*RetryPolicy)(nil).backoff(0); ok {
+		t.Errorf("retried without policy")
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	// The backend comes up after the client connects
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	backend := ln.Addr().String()
+	ln.Close()
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", backend)
+	rp.SetDialTimeout(time.Second)
+	rp.SetRetryPolicy(&RetryPolicy{Retries: 20, Backoff: 20 * time.Millisecond, MaxBackoff: 100 * time.Millisecond})
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	ln, err = net.Listen("tcp", backend)
+	if err != nil {
+		t.Skipf("backend address taken: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			c.Write([]byte("hello"))
+			c.Close()
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, err := io.ReadAll(conn); string(got) != "hello" {
+		t.Errorf("got %q, %v, want hello", got, err)
+	}
+}
+
+func TestBackendHandshakeTimeout(t *testing.T) {
+	// The backend accepts but never answers the handshake
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tls", backendtest.Start(t, nil, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}))
+	if rp.backendHandshakeTimeout != DefaultHandshakeTimeout {
+		t.Errorf("default: got %v, want %v", rp.backendHandshakeTimeout, DefaultHandshakeTimeout)
+	}
+	rp.SetClientConfig(&tls.Config{InsecureSkipVerify: true})
+	rp.SetBackendHandshakeTimeout(100 * time.Millisecond)
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v, want the connection closed", err)
+	}
+}
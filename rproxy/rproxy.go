@@ -17,24 +17,36 @@
 package rproxy
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ccding/go-rproxy/certs"
 )
 
+// DefaultHandshakeTimeout is the default time allowed for a client to finish
+// the TLS handshake with the proxy, and for a tls backend to finish it with
+// the proxy.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// ErrProxyClosed is returned by Start and StartContext after the proxy has
+// been stopped by Shutdown or Close.
+var ErrProxyClosed = errors.New("rproxy: proxy closed")
+
 // RProxy is used to store configurations of the reverse proxy and start
 // running the proxy.
 type RProxy struct {
 	listenProto  string
 	listenAddr   string
-	backendProto string
-	backendAddr  string
+	pool         *Pool
 	rootCert     string
 	serverCert   string
 	serverKey    string
@@ -44,6 +56,52 @@ type RProxy struct {
 	serverConfig *tls.Config
 	serverName   string
 	verbose      bool
+	// handshakeTimeout bounds the TLS handshake with the client
+	handshakeTimeout time.Duration
+	healthCheck      *HealthCheck
+	sniRoutes        map[string]*SNIRoute
+	alpnRoutes       []alpnRoute
+	nextProtos       []string
+	proxyProtocol    int
+	trustedProxies   []*net.IPNet
+	certPolicy       *CertPolicy
+	ipFilter         atomic.Value // *IPFilter
+	rejected         int64
+	rateLimit        *RateLimit
+	buckets          *tokenBuckets
+	rateLimited      int64
+	connLimit        *Limiter
+	globalLimit      *Limiter      // shared by the routes of a Server
+	drop             chan struct{} // closed when the connections are closed
+	bandwidth        *BandwidthLimit
+	bandwidthBuckets *bandwidthBuckets
+	idleTimeout      time.Duration
+	maxLifetime      time.Duration
+	idleClosed       int64
+	expired          int64
+	logger           atomic.Value // *log.Logger
+
+	dialTimeout             time.Duration
+	backendHandshakeTimeout time.Duration
+	retry                   *RetryPolicy
+	datagramSize            int
+	maxSessions             int // of udp
+	unixSocket              *UnixSocket
+
+	mu          sync.Mutex
+	listener    net.Listener
+	packetConn  net.PacketConn // listener of udp
+	udpSessions map[string]*udpSession
+	conns       map[net.Conn]struct{}
+	inflight    sync.WaitGroup
+	closed      bool // no longer accepting connections
+	dropped     bool // proxied connections have been closed forcibly
+	handedOver  bool // the listener was handed over to a replacing route
+
+	// served is closed when the loop serving the listener returns
+	served chan struct{}
+	// replaces is the route the proxy replaces while it starts listening
+	replaces *RProxy
 }
 
 // NewRProxyWithoutCerts creates an RProxy instance without setting
@@ -51,28 +109,32 @@ type RProxy struct {
 // TLS configuration later.
 func NewRProxyWithoutCerts(listenProto, listenAddr, backendProto, backendAddr string) *RProxy {
 	return &RProxy{
-		listenProto:  strings.ToLower(listenProto),
-		listenAddr:   strings.ToLower(listenAddr),
-		backendProto: strings.ToLower(backendProto),
-		backendAddr:  strings.ToLower(backendAddr),
-		verbose:      false,
+		listenProto: strings.ToLower(listenProto),
+		listenAddr:  normalizeAddr(listenProto, listenAddr),
+		pool:        NewPool(nil, NewBackend(backendProto, backendAddr)),
+		verbose:     false,
+
+		handshakeTimeout:        DefaultHandshakeTimeout,
+		backendHandshakeTimeout: DefaultHandshakeTimeout,
 	}
 }
 
 // NewRProxy creates an RProxy instance.
 func NewRProxy(listenProto, listenAddr, backendProto, backendAddr, rootCert, serverCert, serverKey, clientCert, clientKey, serverName string) *RProxy {
 	return &RProxy{
-		listenProto:  strings.ToLower(listenProto),
-		listenAddr:   strings.ToLower(listenAddr),
-		backendProto: strings.ToLower(backendProto),
-		backendAddr:  strings.ToLower(backendAddr),
-		rootCert:     rootCert,
-		serverCert:   serverCert,
-		serverKey:    serverKey,
-		clientCert:   clientCert,
-		clientKey:    clientKey,
-		serverName:   serverName,
-		verbose:      false,
+		listenProto: strings.ToLower(listenProto),
+		listenAddr:  normalizeAddr(listenProto, listenAddr),
+		pool:        NewPool(nil, NewBackend(backendProto, backendAddr)),
+		rootCert:    rootCert,
+		serverCert:  serverCert,
+		serverKey:   serverKey,
+		clientCert:  clientCert,
+		clientKey:   clientKey,
+		serverName:  serverName,
+		verbose:     false,
+
+		handshakeTimeout:        DefaultHandshakeTimeout,
+		backendHandshakeTimeout: DefaultHandshakeTimeout,
 	}
 }
 
@@ -81,6 +143,49 @@ func (rp *RProxy) SetVerbose(v bool) {
 	rp.verbose = v
 }
 
+// SetLogger sets the logger used by the proxy. By default, the standard
+// logger is used. It may be called while the proxy is running.
+func (rp *RProxy) SetLogger(l *log.Logger) {
+	rp.logger.Store(l)
+}
+
+// getLogger returns the logger set by SetLogger, or nil.
+func (rp *RProxy) getLogger() *log.Logger {
+	l, _ := rp.logger.Load().(*log.Logger)
+	return l
+}
+
+// logf prints a log message to the logger of the proxy.
+func (rp *RProxy) logf(format string, v ...interface{}) {
+	if l := rp.getLogger(); l != nil {
+		l.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// SetHandshakeTimeout sets the time allowed for a client to finish the TLS
+// handshake with the proxy. Zero means no timeout.
+func (rp *RProxy) SetHandshakeTimeout(d time.Duration) {
+	rp.handshakeTimeout = d
+}
+
+// AddBackend adds a backend server, so connections are balanced among all the
+// backends.
+func (rp *RProxy) AddBackend(backendProto, backendAddr string) {
+	rp.pool.Add(NewBackend(backendProto, backendAddr))
+}
+
+// SetBalancer sets the strategy used to pick a backend for each connection.
+func (rp *RProxy) SetBalancer(b Balancer) {
+	rp.pool.SetBalancer(b)
+}
+
+// Backends returns the backend servers.
+func (rp *RProxy) Backends() []*Backend {
+	return rp.pool.Backends()
+}
+
 // SetClientConfig sets the config for client (backend TLS).
 func (rp *RProxy) SetClientConfig(config *tls.Config) {
 	rp.clientConfig = config
@@ -91,27 +196,115 @@ func (rp *RProxy) SetServerConfig(config *tls.Config) {
 	rp.serverConfig = config
 }
 
-// Start starts the reverse proxy service.
+// Start starts the reverse proxy service. It blocks until the proxy is
+// stopped by Shutdown or Close, in which case it returns ErrProxyClosed.
 func (rp *RProxy) Start() error {
-	// Check backend protocol and load certificates if TLS
-	switch rp.backendProto {
-	case "tcp":
-	case "tls":
-		// Load client certificates for TLS
-		if rp.clientConfig == nil {
-			config, err := certs.LoadClientCerts(rp.rootCert, rp.clientCert, rp.clientKey, rp.serverName)
-			if err != nil {
-				return err
+	return rp.StartContext(context.Background())
+}
+
+// StartContext starts the reverse proxy service like Start. When ctx is
+// done, the proxy is closed as if Close had been called.
+func (rp *RProxy) StartContext(ctx context.Context) error {
+	if err := rp.listen(); err != nil {
+		return err
+	}
+	return rp.run(ctx)
+}
+
+// listen checks the configuration, loads certificates, and starts listening.
+func (rp *RProxy) listen() error {
+	if rp.proxyProtocol < 0 || rp.proxyProtocol > 2 {
+		return fmt.Errorf("PROXY protocol version %d not supported", rp.proxyProtocol)
+	}
+	// Check backend protocols and load certificates if TLS
+	needClientConfig := false
+	for _, p := range rp.pools() {
+		ownConfig := p.ClientConfig() != nil
+		if rp.healthCheck != nil && rp.healthCheck.Mode == HealthCheckTLS && !ownConfig {
+			needClientConfig = true
+		}
+		for _, b := range p.Backends() {
+			switch b.Proto {
+			case "tcp", "udp", "unix":
+				if (b.Proto == "udp") != (rp.listenProto == "udp") {
+					return errors.New("udp listeners and backends go together")
+				}
+			case "tls":
+				if rp.listenProto == "sni" || rp.listenProto == "udp" {
+					return errors.New("TLS passthrough requires tcp backends")
+				}
+				needClientConfig = needClientConfig || !ownConfig
+			default:
+				return errors.New("backend protocol not supported")
 			}
-			rp.clientConfig = config
 		}
-	default:
-		return errors.New("backend protocol not supported")
+	}
+	// Load client certificates for TLS
+	if needClientConfig && rp.clientConfig == nil {
+		config, err := certs.LoadClientCerts(rp.rootCert, rp.clientCert, rp.clientKey, rp.serverName)
+		if err != nil {
+			return err
+		}
+		rp.clientConfig = config
+	}
+	if rp.retry != nil {
+		if err := rp.retry.validate(); err != nil {
+			return err
+		}
+	}
+	// Check the rate limit
+	if rl := rp.rateLimit; rl != nil {
+		if err := rl.validate(); err != nil {
+			return err
+		}
+		if rl.Key == RateLimitCert && rp.listenProto != "tls" {
+			return errors.New("rate limits by cert require a tls listener")
+		}
+		rp.buckets = newTokenBuckets(rl.Rate, rl.Burst)
+	}
+	if rp.bandwidth != nil {
+		rp.bandwidthBuckets = newBandwidthBuckets(rp.bandwidth)
+	}
+	if rp.unixSocket != nil && rp.listenProto != "unix" {
+		return errors.New("socket file settings require a unix listener")
+	}
+	// Clients of unix listeners have no IP address
+	if rp.listenProto == "unix" {
+		if rp.IPFilter() != nil {
+			return errors.New("IP filters not supported for unix listeners")
+		}
+		if len(rp.trustedProxies) > 0 {
+			return errors.New("PROXY headers not supported for unix listeners")
+		}
+		if rp.rateLimit != nil && rp.rateLimit.Key == RateLimitIP {
+			return errors.New("rate limits by ip not supported for unix listeners")
+		}
+	}
+	// Check client certificate policies
+	for _, policy := range rp.certPolicies() {
+		if rp.listenProto != "tls" {
+			return errors.New("client certificate policies require a tls listener")
+		}
+		if err := policy.Validate(); err != nil {
+			return err
+		}
 	}
 	// Check listen protocol, load certiticates if TLS, and start listening
+	var ln net.Listener
+	var err error
 	switch rp.listenProto {
-	case "tcp":
-		return rp.startTCP()
+	case "tcp", "unix":
+		if len(rp.sniRoutes) > 0 {
+			return errors.New("SNI routes require a tls or sni listener")
+		}
+		if len(rp.alpnRoutes) > 0 {
+			return errors.New("ALPN routes require a tls or sni listener")
+		}
+		if rp.listenProto == "unix" {
+			ln, err = rp.listenUnix()
+		} else {
+			ln, err = rp.listenTCP()
+		}
 	case "tls":
 		// Load server certificates for TLS
 		if rp.serverConfig == nil {
@@ -121,107 +314,537 @@ func (rp *RProxy) Start() error {
 			}
 			rp.serverConfig = config
 		}
-		// Start listening through TLS protocol
-		return rp.startTLS()
+		if len(rp.sniRoutes) > 0 {
+			rp.serverConfig = forEachConfig(rp.serverConfig, rp.sniServerConfig)
+		}
+		if len(rp.nextProtos) > 0 || len(rp.alpnRoutes) > 0 {
+			rp.serverConfig = forEachConfig(rp.serverConfig, rp.alpnServerConfig)
+		}
+		// The TLS handshake is done per connection in handle, so that a
+		// slow client cannot block the accept loop
+		ln, err = rp.listenTCP()
+	case "sni":
+		// TLS passthrough: the ClientHello is peeked per connection in
+		// handle, and the TLS stream is forwarded as is
+		for _, route := range rp.sniRoutes {
+			if route.GetCertificate != nil {
+				return errors.New("TLS passthrough cannot serve certificates")
+			}
+		}
+		ln, err = rp.listenTCP()
+	case "udp":
+		if err := rp.checkUDP(); err != nil {
+			return err
+		}
+		if rp.idleTimeout <= 0 {
+			rp.idleTimeout = DefaultUDPIdleTimeout
+		}
+		pc, err := rp.listenUDP()
+		if err != nil {
+			return err
+		}
+		if err := rp.setPacketConn(pc); err != nil {
+			pc.Close()
+			return err
+		}
+		return nil
 	default:
 		return errors.New("listen protocol not supported")
 	}
+	if err != nil {
+		return err
+	}
+	if err := rp.setListener(ln); err != nil {
+		ln.Close()
+		return err
+	}
+	return nil
 }
 
-func (rp *RProxy) serve(conn net.Conn) error {
-	switch rp.backendProto {
-	case "tcp":
-		return rp.serveTCP(conn)
-	case "tls":
-		return rp.serveTLS(conn)
-	default:
-		return errors.New("backend protocol not supported")
+// run serves the connections accepted by the listener until the proxy is
+// closed.
+func (rp *RProxy) run(ctx context.Context) error {
+	rp.mu.Lock()
+	ln, pc := rp.listener, rp.packetConn
+	served := make(chan struct{})
+	rp.served = served
+	rp.mu.Unlock()
+	defer close(served)
+	if ln == nil && pc == nil {
+		// Handed over before serving
+		return ErrProxyClosed
+	}
+	// Close the proxy once the context is done
+	stop := make(chan struct{})
+	defer close(stop)
+	if rp.healthCheck != nil {
+		go rp.checkHealth(stop)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			rp.Close()
+		case <-stop:
+		}
+	}()
+	if pc != nil {
+		return rp.serveUDP(pc)
+	}
+	return rp.acceptLoop(ln)
+}
+
+// Addr returns the address the proxy is listening on, or nil if it has not
+// started listening yet.
+func (rp *RProxy) Addr() net.Addr {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.packetConn != nil {
+		return rp.packetConn.LocalAddr()
+	}
+	if rp.listener == nil {
+		return nil
+	}
+	return rp.listener.Addr()
+}
+
+// Shutdown gracefully stops the proxy. It closes the listener so no new
+// connections are accepted, then waits for the connections being proxied to
+// finish. If ctx is done before that, the remaining connections are closed
+// forcibly and the context's error is returned.
+func (rp *RProxy) Shutdown(ctx context.Context) error {
+	err := rp.closeListener()
+	done := make(chan struct{})
+	go func() {
+		rp.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		rp.closeConns()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Close immediately stops the proxy, closing the listener and all the
+// connections being proxied.
+func (rp *RProxy) Close() error {
+	err := rp.closeListener()
+	rp.closeConns()
+	return err
+}
+
+func (rp *RProxy) setListener(ln net.Listener) error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.closed {
+		return ErrProxyClosed
+	}
+	rp.dropChan()
+	if rp.listener != nil || rp.packetConn != nil {
+		return errors.New("proxy already started")
+	}
+	rp.listener = ln
+	return nil
+}
+
+func (rp *RProxy) setPacketConn(pc net.PacketConn) error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.closed {
+		return ErrProxyClosed
+	}
+	rp.dropChan()
+	if rp.listener != nil || rp.packetConn != nil {
+		return errors.New("proxy already started")
+	}
+	rp.packetConn = pc
+	return nil
+}
+
+func (rp *RProxy) isClosed() bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.closed
+}
+
+// begin registers a connection being proxied, unless the proxy is closed. It
+// is done under the lock, so that it never races with inflight.Wait.
+func (rp *RProxy) begin() bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.closed {
+		return false
+	}
+	rp.inflight.Add(1)
+	return true
+}
+
+func (rp *RProxy) closeListener() error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.closed = true
+	if rp.packetConn != nil {
+		return rp.packetConn.Close()
+	}
+	if rp.listener == nil {
+		return nil
+	}
+	return rp.listener.Close()
+}
+
+func (rp *RProxy) closeConns() {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if !rp.dropped {
+		close(rp.dropChan())
+	}
+	rp.dropped = true
+	for conn := range rp.conns {
+		conn.Close()
+	}
+}
+
+// dropChan returns the channel closed when the connections are closed. It
+// must be called with rp.mu held.
+func (rp *RProxy) dropChan() chan struct{} {
+	if rp.drop == nil {
+		rp.drop = make(chan struct{})
 	}
+	return rp.drop
 }
 
-func (rp *RProxy) startTCP() error {
+// trackConn registers a connection so that it can be closed forcibly. It
+// reports false, and closes the connection, if the proxied connections have
+// already been closed.
+func (rp *RProxy) trackConn(conn net.Conn) bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.dropped {
+		conn.Close()
+		return false
+	}
+	if rp.conns == nil {
+		rp.conns = make(map[net.Conn]struct{})
+	}
+	rp.conns[conn] = struct{}{}
+	return true
+}
+
+func (rp *RProxy) untrackConn(conn net.Conn) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	delete(rp.conns, conn)
+}
+
+// handle proxies an accepted connection and keeps track of it until done.
+func (rp *RProxy) handle(conn net.Conn) {
+	defer rp.inflight.Done()
+	if !rp.trackConn(conn) {
+		return
+	}
+	defer rp.untrackConn(conn)
+	if len(rp.trustedProxies) > 0 {
+		proxied, err := rp.acceptProxyHeader(conn)
+		if err != nil {
+			rp.logf("PROXY header error: %v: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		if proxied != conn && !rp.admit(proxied) {
+			return
+		}
+		conn = proxied
+	}
+	if !rp.limitRate(conn) {
+		return
+	}
+	for _, l := range rp.limiters() {
+		if err := l.acquire(rp.drop); err != nil {
+			rp.logf("connection limit: %v rejected", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		defer l.release()
+	}
+	if rp.listenProto == "tls" {
+		tlsConn := tls.Server(conn, rp.serverConfig)
+		if err := rp.handshake(tlsConn); err != nil {
+			rp.logf("handshake error: %v: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		if err := rp.authorize(tlsConn); err != nil {
+			rp.logf("authorization error: %v: %v", conn.RemoteAddr(), err)
+			tlsConn.Close()
+			return
+		}
+		if rp.rateLimit != nil && rp.rateLimit.Key == RateLimitCert && !rp.limitRate(tlsConn) {
+			return
+		}
+		conn = tlsConn
+	}
+	if rp.listenProto == "sni" {
+		peeked, err := rp.peek(conn)
+		if err != nil {
+			rp.logf("client hello error: %v: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		conn = peeked
+	}
+	if err := rp.serve(conn); err != nil {
+		rp.logf("serve error: %v", err)
+	}
+}
+
+func (rp *RProxy) listenTCP() (net.Listener, error) {
+	if ln := rp.inheritListener(); ln != nil {
+		return ln, nil
+	}
 	// Resolve network address
 	lAddr, err := net.ResolveTCPAddr("tcp", rp.listenAddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// Listen to TCP connections
-	ln, err := net.ListenTCP("tcp", lAddr)
-	if err != nil {
-		return err
-	}
-	defer ln.Close()
+	return net.ListenTCP("tcp", lAddr)
+}
+
+func (rp *RProxy) acceptLoop(ln net.Listener) error {
+	defer func() {
+		if !rp.isHandedOver() {
+			ln.Close()
+		}
+	}()
 	// Handle connections
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("accept error: %v", err)
+			if rp.isClosed() {
+				return ErrProxyClosed
+			}
+			rp.logf("accept error: %v", err)
 			continue
 		}
-		go func() {
-			if err := rp.serve(conn); err != nil {
-				log.Printf("serve error: %v", err)
-			}
-		}()
+		// Connections of trusted proxies are checked once their header
+		// is read
+		if !containsAddr(rp.trustedProxies, conn.RemoteAddr()) && !rp.admit(conn) {
+			continue
+		}
+		if !rp.begin() {
+			conn.Close()
+			return ErrProxyClosed
+		}
+		go rp.handle(conn)
 	}
 }
 
-func (rp *RProxy) startTLS() error {
-	// Listen to TLS connections
-	ln, err := tls.Listen("tcp", rp.listenAddr, rp.serverConfig)
-	if err != nil {
+// handshake runs the server side TLS handshake within the handshake timeout.
+func (rp *RProxy) handshake(conn *tls.Conn) error {
+	if rp.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(rp.handshakeTimeout))
+	}
+	if err := conn.Handshake(); err != nil {
 		return err
 	}
-	defer ln.Close()
-	// Handle connections
-	for {
-		conn, err := ln.Accept()
+	return conn.SetDeadline(time.Time{})
+}
+
+// peek reads the ClientHello of a passthrough connection within the
+// handshake timeout.
+func (rp *RProxy) peek(conn net.Conn) (*peekedConn, error) {
+	if rp.handshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(rp.handshakeTimeout))
+	}
+	raw, hello, err := readClientHello(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return newPeekedConn(conn, raw, hello), nil
+}
+
+func (rp *RProxy) serve(listenConn net.Conn) error {
+	p := rp.pickPool(listenConn)
+	header := rp.proxyHeader(listenConn)
+	failovers := 0
+	for attempt := 0; ; {
+		// Pick the backend server
+		b, err := p.Pick(listenConn.RemoteAddr())
 		if err != nil {
-			log.Printf("accept error (%v)", err)
+			listenConn.Close()
+			return err
+		}
+		dialed, err := rp.serveBackend(listenConn, p, b, header)
+		if dialed {
+			return err
+		}
+		if err == errFailedOver {
+			continue
+		}
+		// Fail over to the next backend at once, while there is one
+		if p.dialFailed(b) && failovers < len(p.Backends())-1 {
+			failovers++
+			rp.logf("dial error: %v, failing over", err)
 			continue
 		}
-		if err := rp.serve(conn); err != nil {
-			log.Printf("serve error: %v", err)
+		failovers = 0
+		// Retry the failed dial after a backoff
+		wait, ok := rp.retry.backoff(attempt)
+		attempt++
+		if !ok {
+			listenConn.Close()
+			return err
+		}
+		rp.logf("dial error: %v, retrying in %v", err, wait)
+		if !rp.sleep(wait) {
+			listenConn.Close()
+			return ErrProxyClosed
 		}
 	}
 }
 
-func (rp *RProxy) serveTCP(listenConn net.Conn) error {
+// serveBackend proxies the listen connection to backend b of pool p. It
+// reports false if dialing b failed, in which case the listen connection is
+// left open for another attempt.
+func (rp *RProxy) serveBackend(listenConn net.Conn, p *Pool, b *Backend, header []byte) (dialed bool, err error) {
+	if l := b.ConnLimit(); l != nil {
+		if err := l.acquire(rp.drop); err != nil {
+			listenConn.Close()
+			return true, fmt.Errorf("backend %v: %v", b, err)
+		}
+		defer l.release()
+	}
+	b.acquire()
+	defer b.release()
 	// Dial to the backend server
-	backendConn, err := net.DialTimeout("tcp", rp.backendAddr, 30*time.Second)
+	clientConfig := rp.clientConfigFor(p)
+	if proto := negotiatedProtocol(listenConn); proto != "" && b.Proto == "tls" {
+		clientConfig = withNextProto(clientConfig, proto)
+	}
+	backendConn, err := rp.dial(b, clientConfig, header)
 	if err != nil {
-		listenConn.Close()
-		return err
+		return false, fmt.Errorf("backend %v: %v", b, err)
 	}
-	// Copy network traffic from the listen connection to backend connection
-	go func() {
-		io.Copy(NewRPWriteCloser(backendConn), NewRPReader(listenConn, rp.verbose))
+	p.dialSucceeded(b)
+	if !b.track(backendConn) {
 		backendConn.Close()
-		listenConn.Close()
-	}()
-	// Copy network traffic from the backend connection to listen connection
-	io.Copy(NewRPWriteCloser(listenConn), NewRPReader(backendConn, rp.verbose))
-	backendConn.Close()
-	listenConn.Close()
-	return nil
+		return false, errFailedOver
+	}
+	defer b.untrack(backendConn)
+	return true, rp.proxy(listenConn, backendConn)
 }
 
-func (rp *RProxy) serveTLS(listenConn net.Conn) error {
-	// Dial to the beckend server
-	backendConn, err := tls.Dial("tcp", rp.backendAddr, rp.clientConfig)
+// dial connects to the backend server, sending header, if any, ahead of the
+// TLS handshake for tls backends.
+func (rp *RProxy) dial(b *Backend, clientConfig *tls.Config, header []byte) (net.Conn, error) {
+	if b.Proto != "tcp" && b.Proto != "tls" && b.Proto != "unix" {
+		return nil, errors.New("backend protocol not supported")
+	}
+	timeout := rp.dialTimeout
+	if timeout <= 0 {
+		timeout = DefaultDialTimeout
+	}
+	conn, err := net.DialTimeout(b.network(), b.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > 0 {
+		if _, err := conn.Write(header); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if b.Proto != "tls" {
+		return conn, nil
+	}
+	clientConfig, err = withServerName(clientConfig, b.Addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, clientConfig)
+	if rp.backendHandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(rp.backendHandshakeTimeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// withServerName returns config, or if it sets no server name, a copy of it
+// verifying the host name of addr, as tls.Dial does.
+func withServerName(config *tls.Config, addr string) (*tls.Config, error) {
+	if config.ServerName != "" {
+		return config, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
+		return nil, err
+	}
+	config = config.Clone()
+	config.ServerName = host
+	return config, nil
+}
+
+// proxy copies network traffic between the listen connection and backend
+// connection until both directions are done, then closes both connections.
+func (rp *RProxy) proxy(listenConn, backendConn net.Conn) error {
+	if !rp.trackConn(backendConn) {
 		listenConn.Close()
-		return err
+		return ErrProxyClosed
 	}
+	defer rp.untrackConn(backendConn)
+	up, down := rp.throttles(listenConn)
+	activity := time.Now().UnixNano()
+	stop := rp.watch(listenConn, backendConn, &activity)
+	defer stop()
 	// Copy network traffic from the listen connection to backend connection
+	done := make(chan struct{})
 	go func() {
-		io.Copy(NewRPWriteCloser(backendConn), NewRPReader(listenConn, rp.verbose))
-		backendConn.Close()
-		listenConn.Close()
+		rp.copy(backendConn, listenConn, up, &activity)
+		close(done)
 	}()
 	// Copy network traffic from the backend connection to listen connection
-	io.Copy(NewRPWriteCloser(listenConn), NewRPReader(backendConn, rp.verbose))
+	rp.copy(listenConn, backendConn, down, &activity)
+	<-done
 	backendConn.Close()
 	listenConn.Close()
 	return nil
 }
+
+// copy copies network traffic from src to dst at the rates of throttles,
+// recording the time of each read in activity. When src reaches EOF, only the
+// write side of dst is shut down so that the other direction keeps flowing;
+// on any other error both connections are closed.
+func (rp *RProxy) copy(dst, src net.Conn, throttles []throttle, activity *int64) {
+	w := NewRPWriteCloser(dst).(*RPWriteCloser)
+	r := &RPReader{
+		Reader:    src,
+		verbose:   rp.verbose,
+		logger:    rp.getLogger(),
+		throttles: throttles,
+		cancel:    rp.drop,
+		activity:  activity,
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		dst.Close()
+		src.Close()
+		return
+	}
+	if err := w.CloseWrite(); err != nil {
+		dst.Close()
+		src.Close()
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+// testPKI is an in-memory CA issuing certificates for tests.
+type testPKI struct {
+	t    *testing.T
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "testapp-root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate error: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testPKI{t: t, cert: cert, key: key, pool: pool}
+}
+
+// issue creates a certificate signed by the CA with template fields set.
+func (p *testPKI) issue(template *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		p.t.Fatalf("generate key error: %v", err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.cert, &key.PublicKey, p.key)
+	if err != nil {
+		p.t.Fatalf("create certificate error: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		p.t.Fatalf("parse certificate error: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeFiles writes the CA certificate, and a certificate for the given DNS
+// name with its key, as PEM files to dir, and returns their paths.
+func (p *testPKI) writeFiles(dir, name string) (root, cert, key string) {
+	issued := p.issue(&x509.Certificate{Subject: pkix.Name{CommonName: name}, DNSNames: []string{name}})
+	der, err := x509.MarshalPKCS8PrivateKey(issued.PrivateKey)
+	if err != nil {
+		p.t.Fatalf("marshal key error: %v", err)
+	}
+	root, cert, key = filepath.Join(dir, "root.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for path, block := range map[string]*pem.Block{
+		root: {Type: "CERTIFICATE", Bytes: p.cert.Raw},
+		cert: {Type: "CERTIFICATE", Bytes: issued.Certificate[0]},
+		key:  {Type: "PRIVATE KEY", Bytes: der},
+	} {
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			p.t.Fatalf("write error: %v", err)
+		}
+	}
+	return root, cert, key
+}
+
+// serverConfig returns a mutual TLS server config for the given DNS name.
+func (p *testPKI) serverConfig(name string) *tls.Config {
+	cert := p.issue(&x509.Certificate{Subject: pkix.Name{CommonName: name}, DNSNames: []string{name}})
+	return &tls.Config{
+		ClientCAs:    p.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		Certificates: []tls.Certificate{cert},
+	}
+}
+
+// clientConfig returns a client config with a certificate for commonName.
+func (p *testPKI) clientConfig(commonName, serverName string) *tls.Config {
+	cert := p.issue(&x509.Certificate{Subject: pkix.Name{CommonName: commonName}})
+	return &tls.Config{
+		RootCAs:      p.pool,
+		ServerName:   serverName,
+		Certificates: []tls.Certificate{cert},
+	}
+}
+
+// startProxy starts rp in the background and waits until it is listening.
+func startProxy(t *testing.T, rp *RProxy) (string, chan error) {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- rp.Start()
+	}()
+	for i := 0; i < 100; i++ {
+		if addr := rp.Addr(); addr != nil {
+			return addr.String(), errc
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("proxy did not start")
+	return "", nil
+}
+
+func TestShutdown(t *testing.T) {
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Echo))
+	addr, errc := startProxy(t, rp)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Fatalf("echo: got %q, %v", line, err)
+	}
+
+	// The connection is still open, so Shutdown must force-close it.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := rp.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("shutdown: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := <-errc; err != ErrProxyClosed {
+		t.Errorf("start: got %v, want %v", err, ErrProxyClosed)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("dial after shutdown succeeded")
+	}
+}
+
+func TestShutdownGraceful(t *testing.T) {
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Echo))
+	addr, errc := startProxy(t, rp)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if line, err := r.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Fatalf("echo: got %q, %v", line, err)
+	}
+
+	// The connection keeps working during Shutdown, which returns once
+	// the client closes it, well before the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- rp.Shutdown(ctx)
+	}()
+	if err := <-errc; err != ErrProxyClosed {
+		t.Errorf("start: got %v, want %v", err, ErrProxyClosed)
+	}
+	if _, err := conn.Write([]byte("again\n")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if line, err := r.ReadString('\n'); err != nil || line != "again\n" {
+		t.Errorf("echo during shutdown: got %q, %v", line, err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown returned with a connection open: %v", err)
+	default:
+	}
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("shutdown: got %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("shutdown did not return after the connection closed")
+	}
+}
+
+func TestStartContext(t *testing.T) {
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Echo))
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- rp.StartContext(ctx)
+	}()
+	cancel()
+	select {
+	case err := <-errc:
+		if err != ErrProxyClosed {
+			t.Errorf("start: got %v, want %v", err, ErrProxyClosed)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("proxy did not stop after cancel")
+	}
+}
+
+func TestStalledHandshake(t *testing.T) {
+	pki := newTestPKI(t)
+	serverConfig := pki.serverConfig("testapp-server")
+	clientConfig := pki.clientConfig("testapp-client-0", "testapp-server")
+	rp := NewRProxyWithoutCerts("tls", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Echo))
+	rp.SetServerConfig(serverConfig)
+	rp.SetHandshakeTimeout(time.Second)
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	// A client that never sends its ClientHello must not block others.
+	stalled, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer stalled.Close()
+
+	conn, err := tls.Dial("tcp", addr, clientConfig)
+	if err != nil {
+		t.Fatalf("tls dial error: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Fatalf("echo: got %q, %v", line, err)
+	}
+
+	// The stalled client is dropped once the handshake timeout fires.
+	stalled.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stalled.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("stalled read: got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	// The backend reads the whole request and only then replies.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, _ := io.ReadAll(conn)
+		conn.Write(append([]byte("re: "), req...))
+	}()
+
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", ln.Addr().String())
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := io.ReadAll(conn)
+	if err != nil || string(resp) != "re: ping" {
+		t.Errorf("response: got %q, %v", resp, err)
+	}
+}
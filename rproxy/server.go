@@ -0,0 +1,300 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// Server runs many routes, each an RProxy from one listen address to its
+// backends, in one process with one logger and one lifecycle.
+type Server struct {
+	mu      sync.Mutex
+	routes  map[string]*RProxy
+	logger  *log.Logger
+	limit   *Limiter
+	ctx     context.Context // context of the running server
+	running bool
+	done    chan struct{} // closed when the server is stopped
+	wg      sync.WaitGroup
+	drains  []chan struct{} // each closed when a removed route is shut down
+}
+
+// NewServer creates an empty Server.
+func NewServer() *Server {
+	return &Server{
+		routes: make(map[string]*RProxy),
+		done:   make(chan struct{}),
+	}
+}
+
+// SetLogger sets the logger shared by all the routes.
+func (s *Server) SetLogger(l *log.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger = l
+	for _, rp := range s.routes {
+		rp.SetLogger(l)
+	}
+}
+
+// Add adds a route named name. If the server is running, the route starts
+// listening immediately and any listening error is returned.
+func (s *Server) Add(name string, rp *RProxy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.routes[name]; ok {
+		return fmt.Errorf("route %s already exists", name)
+	}
+	if s.logger != nil {
+		rp.SetLogger(s.logger)
+	}
+	rp.setGlobalLimit(s.limit)
+	if s.running {
+		if err := rp.listen(); err != nil {
+			return fmt.Errorf("route %s: %v", name, err)
+		}
+		s.run(name, rp)
+	}
+	s.routes[name] = rp
+	return nil
+}
+
+// Remove removes the route named name. The route stops accepting connections
+// at once, and its connections are shut down gracefully in the background as
+// RProxy.Shutdown does with ctx.
+func (s *Server) Remove(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rp, ok := s.routes[name]
+	if !ok {
+		return fmt.Errorf("route %s does not exist", name)
+	}
+	delete(s.routes, name)
+	s.drain(ctx, name, rp)
+	return nil
+}
+
+// Replace replaces the route named name by rp. The old route keeps serving
+// until rp is listening; if both use the same address, rp takes over the
+// listener of the old route, so that no connection is refused meanwhile. The
+// connections of the old route are then shut down gracefully in the
+// background as RProxy.Shutdown does with ctx. If rp fails to listen, the old
+// route is kept and the error is returned.
+func (s *Server) Replace(ctx context.Context, name string, rp *RProxy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.routes[name]
+	if !ok {
+		return fmt.Errorf("route %s does not exist", name)
+	}
+	if s.logger != nil {
+		rp.SetLogger(s.logger)
+	}
+	rp.setGlobalLimit(s.limit)
+	if s.running {
+		rp.replaces = old
+		err := rp.listen()
+		rp.replaces = nil
+		if err != nil {
+			return fmt.Errorf("route %s: %v", name, err)
+		}
+	}
+	s.drain(ctx, name, old)
+	if s.running {
+		s.run(name, rp)
+	}
+	s.routes[name] = rp
+	return nil
+}
+
+// drain shuts down a removed route in the background. It must be called
+// with s.mu held.
+func (s *Server) drain(ctx context.Context, name string, rp *RProxy) {
+	rp.closeListener()
+	if s.running {
+		s.wg.Add(1)
+	}
+	done := make(chan struct{})
+	s.drains = append(s.drains, done)
+	go func(running bool) {
+		if running {
+			defer s.wg.Done()
+		}
+		defer close(done)
+		if err := rp.Shutdown(ctx); err != nil {
+			rp.logf("route %s: shutdown: %v", name, err)
+		}
+	}(s.running)
+}
+
+// Drained returns a channel closed once the routes removed or replaced so
+// far have shut down.
+func (s *Server) Drained() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pending []chan struct{}
+	for _, done := range s.drains {
+		select {
+		case <-done:
+		default:
+			pending = append(pending, done)
+		}
+	}
+	s.drains = pending
+	drained := make(chan struct{})
+	go func() {
+		for _, done := range pending {
+			<-done
+		}
+		close(drained)
+	}()
+	return drained
+}
+
+// Logger returns the logger shared by all the routes.
+func (s *Server) Logger() *log.Logger {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.logger == nil {
+		return log.Default()
+	}
+	return s.logger
+}
+
+// Route returns the route named name, or nil if there is none.
+func (s *Server) Route(name string) *RProxy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.routes[name]
+}
+
+// Routes returns the sorted names of the routes.
+func (s *Server) Routes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.routes))
+	for name := range s.routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Start starts all the routes. It blocks until the server is stopped by
+// Shutdown or Close, in which case it returns ErrProxyClosed. If any route
+// fails to listen, no route is started and the error is returned.
+func (s *Server) Start() error {
+	return s.StartContext(context.Background())
+}
+
+// StartContext starts the server like Start. When ctx is done, the server is
+// closed as if Close had been called.
+func (s *Server) StartContext(ctx context.Context) error {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return errors.New("server already started")
+	}
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return ErrProxyClosed
+	default:
+	}
+	var started []*RProxy
+	for name, rp := range s.routes {
+		if err := rp.listen(); err != nil {
+			for _, rp := range started {
+				rp.Close()
+			}
+			s.mu.Unlock()
+			return fmt.Errorf("route %s: %v", name, err)
+		}
+		started = append(started, rp)
+	}
+	s.ctx = ctx
+	s.running = true
+	for name, rp := range s.routes {
+		s.run(name, rp)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		s.Close()
+	case <-s.done:
+	}
+	s.wg.Wait()
+	return ErrProxyClosed
+}
+
+// run serves a listening route in the background.
+func (s *Server) run(name string, rp *RProxy) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := rp.run(s.ctx); err != ErrProxyClosed {
+			rp.logf("route %s: %v", name, err)
+		}
+	}()
+}
+
+// Shutdown gracefully stops all the routes as RProxy.Shutdown does, and
+// returns the first error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.stop(func(rp *RProxy) error { return rp.Shutdown(ctx) })
+}
+
+// Close immediately stops all the routes as RProxy.Close does.
+func (s *Server) Close() error {
+	return s.stop(func(rp *RProxy) error { return rp.Close() })
+}
+
+func (s *Server) stop(stop func(*RProxy) error) error {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	s.running = false
+	routes := make([]*RProxy, 0, len(s.routes))
+	for _, rp := range s.routes {
+		routes = append(routes, rp)
+	}
+	s.mu.Unlock()
+
+	errc := make(chan error, len(routes))
+	for _, rp := range routes {
+		go func(rp *RProxy) {
+			errc <- stop(rp)
+		}(rp)
+	}
+	var err error
+	for range routes {
+		if e := <-errc; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,212 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+// waitAddr waits until rp is listening and returns its address.
+func waitAddr(t *testing.T, rp *RProxy) string {
+	for i := 0; i < 100; i++ {
+		if addr := rp.Addr(); addr != nil {
+			return addr.String()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("route did not start")
+	return ""
+}
+
+func TestServer(t *testing.T) {
+	echo := backendtest.Start(t, nil, backendtest.Echo)
+	srv := NewServer()
+	a := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", echo)
+	if err := srv.Add("a", a); err != nil {
+		t.Fatalf("add error: %v", err)
+	}
+	if err := srv.Add("a", a); err == nil {
+		t.Errorf("adding a duplicate route succeeded")
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Start()
+	}()
+	waitAddr(t, a)
+
+	// Routes added to a running server start immediately.
+	b := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", echo)
+	if err := srv.Add("b", b); err != nil {
+		t.Fatalf("add error: %v", err)
+	}
+	addrB := waitAddr(t, b)
+	if got := srv.Routes(); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("routes: got %v", got)
+	}
+
+	// A removed route stops listening while the others keep serving.
+	if err := srv.Remove(context.Background(), "b"); err != nil {
+		t.Errorf("remove error: %v", err)
+	}
+	if _, err := net.Dial("tcp", addrB); err == nil {
+		t.Errorf("dial removed route succeeded")
+	}
+	conn, err := net.Dial("tcp", a.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	conn.Close()
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown error: %v", err)
+	}
+	if err := <-errc; err != ErrProxyClosed {
+		t.Errorf("start: got %v, want %v", err, ErrProxyClosed)
+	}
+}
+
+func TestServerSetLoggerRunning(t *testing.T) {
+	// Every connection logs, as the backend is down
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	dead := ln.Addr().String()
+	ln.Close()
+	srv := NewServer()
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", dead)
+	if err := srv.Add("a", rp); err != nil {
+		t.Fatalf("add error: %v", err)
+	}
+	go srv.Start()
+	defer srv.Close()
+	addr := waitAddr(t, rp)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if conn, err := net.Dial("tcp", addr); err == nil {
+				conn.Read(make([]byte, 1))
+				conn.Close()
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		srv.SetLogger(log.New(io.Discard, "", 0))
+	}
+	<-done
+}
+
+func TestServerReplace(t *testing.T) {
+	srv := NewServer()
+	old := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Echo))
+	if err := srv.Add("a", old); err != nil {
+		t.Fatalf("add error: %v", err)
+	}
+	go srv.Start()
+	defer srv.Close()
+	addr := waitAddr(t, old)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	echo := func() error {
+		conn.Write([]byte("x"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := io.ReadFull(conn, make([]byte, 1))
+		return err
+	}
+	if err := echo(); err != nil {
+		t.Fatalf("read through the old route: %v", err)
+	}
+
+	// A route failing to listen leaves the old one serving.
+	busy := NewRProxyWithoutCerts("tcp", backendtest.Start(t, nil, backendtest.Echo), "tcp", backendtest.Start(t, nil, backendtest.Banner("busy")))
+	if err := srv.Replace(context.Background(), "a", busy); err == nil {
+		t.Errorf("replace with a busy address succeeded")
+	}
+	if srv.Route("a") != old {
+		t.Errorf("failed replace removed the old route")
+	}
+
+	// A route on the same address takes the listener over, while the
+	// connections of the old route finish.
+	rp := NewRProxyWithoutCerts("tcp", addr, "tcp", backendtest.Start(t, nil, backendtest.Banner("new")))
+	if err := srv.Replace(context.Background(), "a", rp); err != nil {
+		t.Fatalf("replace error: %v", err)
+	}
+	c, got := readName(t, addr)
+	c.Close()
+	if got != "new" {
+		t.Errorf("new connection: got %q, want %q", got, "new")
+	}
+	if err := echo(); err != nil {
+		t.Errorf("read through the old route after replace: %v", err)
+	}
+}
+
+func TestServerDrained(t *testing.T) {
+	srv := NewServer()
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Echo))
+	if err := srv.Add("a", rp); err != nil {
+		t.Fatalf("add error: %v", err)
+	}
+	go srv.Start()
+	defer srv.Close()
+	conn, err := net.Dial("tcp", waitAddr(t, rp))
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("x")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+
+	// The removed route drains until its connection is closed
+	if err := srv.Remove(context.Background(), "a"); err != nil {
+		t.Fatalf("remove error: %v", err)
+	}
+	drained := srv.Drained()
+	select {
+	case <-drained:
+		t.Errorf("drained with a connection open")
+	case <-time.After(100 * time.Millisecond):
+	}
+	conn.Close()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Errorf("not drained after the connection closed")
+	}
+	select {
+	case <-srv.Drained():
+	case <-time.After(5 * time.Second):
+		t.Errorf("nothing left to drain: not drained")
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+)
+
+// SNIRoute routes TLS connections by the server name that clients send in
+// the ClientHello.
+type SNIRoute struct {
+	// ServerName is an exact name such as www.example.com, or a wildcard
+	// such as *.example.com matching a single label.
+	ServerName string
+	// Pool holds the backends of the route, with their own client config
+	// if they need one. If nil, the default backends are used.
+	Pool *Pool
+	// GetCertificate returns the certificate served to the clients of the
+	// route. If nil, the default certificate is served.
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	// CertPolicy authorizes the clients of the route. If nil, the policy
+	// of the listener is used.
+	CertPolicy *CertPolicy
+}
+
+// AddSNIRoute adds a route for the connections asking for a server name.
+// Exact names take precedence over wildcards, and connections matching no
+// route go to the default backends. It must be called before Start.
+//
+// SNI routes work with the tls listen protocol, which terminates TLS, and
+// with the sni listen protocol, which forwards the TLS stream as is to tcp
+// backends after reading the server name from the ClientHello.
+func (rp *RProxy) AddSNIRoute(route *SNIRoute) {
+	if rp.sniRoutes == nil {
+		rp.sniRoutes = make(map[string]*SNIRoute)
+	}
+	rp.sniRoutes[normalizeServerName(route.ServerName)] = route
+}
+
+// matchSNI returns the route for serverName, or nil if there is none.
+func (rp *RProxy) matchSNI(serverName string) *SNIRoute {
+	name := normalizeServerName(serverName)
+	if name == "" {
+		return nil
+	}
+	if route, ok := rp.sniRoutes[name]; ok {
+		return route
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return rp.sniRoutes["*"+name[i:]]
+	}
+	return nil
+}
+
+func normalizeServerName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// sniServerConfig returns a copy of config serving the certificates of the
+// SNI routes.
+func (rp *RProxy) sniServerConfig(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	getCertificate := config.GetCertificate
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if route := rp.matchSNI(hello.ServerName); route != nil && route.GetCertificate != nil {
+			return route.GetCertificate(hello)
+		}
+		if getCertificate != nil {
+			return getCertificate(hello)
+		}
+		// Fall back to config.Certificates
+		return nil, nil
+	}
+	return config
+}
+
+// forEachConfig returns update(config), whose GetConfigForClient, if any,
+// returns the configs updated as well, such as those of a certs.Reloader.
+func forEachConfig(config *tls.Config, update func(*tls.Config) *tls.Config) *tls.Config {
+	config = update(config)
+	if get := config.GetConfigForClient; get != nil {
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := get(hello)
+			if c == nil || err != nil {
+				return c, err
+			}
+			return update(c), nil
+		}
+	}
+	return config
+}
+
+// pickPool returns the pool of backends for a client connection, by its SNI
+// server name first, then by its ALPN protocol.
+func (rp *RProxy) pickPool(conn net.Conn) *Pool {
+	var serverName string
+	var protos []string
+	switch c := conn.(type) {
+	case *tls.Conn:
+		cs := c.ConnectionState()
+		serverName = cs.ServerName
+		if cs.NegotiatedProtocol != "" {
+			protos = []string{cs.NegotiatedProtocol}
+		}
+	case *peekedConn:
+		serverName = c.hello.serverName
+		protos = c.hello.alpn
+	}
+	if route := rp.matchSNI(serverName); route != nil && route.Pool != nil {
+		return route.Pool
+	}
+	if pool := rp.matchALPN(protos); pool != nil {
+		return pool
+	}
+	return rp.pool
+}
+
+// pools returns all the pools of backends, the default one first.
+func (rp *RProxy) pools() []*Pool {
+	pools := []*Pool{rp.pool}
+	seen := map[*Pool]bool{rp.pool: true}
+	for _, route := range rp.sniRoutes {
+		if route.Pool != nil && !seen[route.Pool] {
+			seen[route.Pool] = true
+			pools = append(pools, route.Pool)
+		}
+	}
+	for _, route := range rp.alpnRoutes {
+		if !seen[route.pool] {
+			seen[route.pool] = true
+			pools = append(pools, route.pool)
+		}
+	}
+	return pools
+}
+
+// clientConfigFor returns the config for dialing the TLS backends of a pool.
+func (rp *RProxy) clientConfigFor(p *Pool) *tls.Config {
+	if config := p.ClientConfig(); config != nil {
+		return config
+	}
+	return rp.clientConfig
+}
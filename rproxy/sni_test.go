@@ -0,0 +1,77 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"testing"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+func TestSNIRoute(t *testing.T) {
+	pki := newTestPKI(t)
+	rp := NewRProxyWithoutCerts("tls", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Banner("default")))
+	rp.SetServerConfig(pki.serverConfig("default.test"))
+	wildcard := pki.issue(&x509.Certificate{Subject: pkix.Name{CommonName: "*.example.com"}, DNSNames: []string{"*.example.com"}})
+	rp.AddSNIRoute(&SNIRoute{
+		ServerName: "*.example.com",
+		Pool:       NewPool(nil, NewBackend("tcp", backendtest.Start(t, nil, backendtest.Banner("wildcard")))),
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &wildcard, nil
+		},
+	})
+	rp.AddSNIRoute(&SNIRoute{
+		ServerName: "WWW.example.com",
+		Pool:       NewPool(nil, NewBackend("tcp", backendtest.Start(t, nil, backendtest.Banner("exact")))),
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &wildcard, nil
+		},
+	})
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"default.test", "default"},
+		{"api.example.com", "wildcard"},
+		{"www.example.com", "exact"},
+		{"a.b.example.com", "default"},
+	}
+	for _, tt := range tests {
+		config := pki.clientConfig("testapp-client-0", tt.serverName)
+		if tt.want == "default" && tt.serverName != "default.test" {
+			// The default certificate does not cover the name
+			config.InsecureSkipVerify = true
+		}
+		conn, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			t.Errorf("%s: dial error: %v", tt.serverName, err)
+			continue
+		}
+		got, err := io.ReadAll(conn)
+		conn.Close()
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.serverName, got, err, tt.want)
+		}
+	}
+}
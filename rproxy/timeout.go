@@ -0,0 +1,116 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons for closing connections, as logged.
+const (
+	closedIdle     = "idle timeout"
+	closedLifetime = "max lifetime"
+)
+
+// SetIdleTimeout makes the proxy close connections after no data moved in
+// either direction for d. Zero, the default, disables it.
+func (rp *RProxy) SetIdleTimeout(d time.Duration) {
+	rp.idleTimeout = d
+}
+
+// SetMaxLifetime makes the proxy close connections open for longer than d,
+// whether active or not. Zero, the default, disables it.
+func (rp *RProxy) SetMaxLifetime(d time.Duration) {
+	rp.maxLifetime = d
+}
+
+// IdleClosedConns returns the number of connections closed by the idle
+// timeout.
+func (rp *RProxy) IdleClosedConns() int64 {
+	return atomic.LoadInt64(&rp.idleClosed)
+}
+
+// ExpiredConns returns the number of connections closed by the maximum
+// lifetime.
+func (rp *RProxy) ExpiredConns() int64 {
+	return atomic.LoadInt64(&rp.expired)
+}
+
+// watch closes a proxied connection once the idle timeout or the maximum
+// lifetime is reached. The time of the last activity is read from activity,
+// in Unix nanoseconds. It returns a function stopping the watch.
+func (rp *RProxy) watch(listenConn, backendConn net.Conn, activity *int64) (stop func()) {
+	if rp.idleTimeout <= 0 && rp.maxLifetime <= 0 {
+		return func() {}
+	}
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		_, next := rp.checkTimeouts(start, start, start)
+		timer := time.NewTimer(next)
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+			now := time.Now()
+			reason, next := rp.checkTimeouts(start, time.Unix(0, atomic.LoadInt64(activity)), now)
+			if reason == "" {
+				timer.Reset(next)
+				continue
+			}
+			if reason == closedIdle {
+				atomic.AddInt64(&rp.idleClosed, 1)
+			} else {
+				atomic.AddInt64(&rp.expired, 1)
+			}
+			rp.logf("connection closed: %v: %s", listenConn.RemoteAddr(), reason)
+			listenConn.Close()
+			backendConn.Close()
+			return
+		}
+	}()
+	return func() { close(done) }
+}
+
+// checkTimeouts returns the limit reached at now by a connection started at
+// start with its last activity at last, or else how long until the next
+// check.
+func (rp *RProxy) checkTimeouts(start, last, now time.Time) (reason string, next time.Duration) {
+	next = -1
+	if rp.maxLifetime > 0 {
+		left := rp.maxLifetime - now.Sub(start)
+		if left <= 0 {
+			return closedLifetime, 0
+		}
+		next = left
+	}
+	if rp.idleTimeout > 0 {
+		left := rp.idleTimeout - now.Sub(last)
+		if left <= 0 {
+			return closedIdle, 0
+		}
+		if next < 0 || left < next {
+			next = left
+		}
+	}
+	return "", next
+}
@@ -0,0 +1,111 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+func TestCheckTimeouts(t *testing.T) {
+	rp := &RProxy{idleTimeout: 10 * time.Second, maxLifetime: time.Minute}
+	start := time.Now()
+	tests := []struct {
+		last, now time.Duration // since start
+		reason    string
+		next      time.Duration
+	}{
+		{0, 0, "", 10 * time.Second},
+		{5 * time.Second, 8 * time.Second, "", 7 * time.Second},
+		{5 * time.Second, 15 * time.Second, closedIdle, 0},
+		{55 * time.Second, 58 * time.Second, "", 2 * time.Second},
+		{59 * time.Second, time.Minute, closedLifetime, 0},
+	}
+	for _, tt := range tests {
+		reason, next := rp.checkTimeouts(start, start.Add(tt.last), start.Add(tt.now))
+		if reason != tt.reason || next != tt.next {
+			t.Errorf("last %v, now %v: got %q, %v, want %q, %v", tt.last, tt.now, reason, next, tt.reason, tt.next)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Echo))
+	rp.SetIdleTimeout(200 * time.Millisecond)
+	rp.SetMaxLifetime(time.Minute)
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	// Activity keeps the connection open past the idle timeout
+	buf := make([]byte, 1)
+	for i := 0; i < 5; i++ {
+		conn.Write([]byte("x"))
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(buf); err == nil || isTimeout(err) {
+		t.Errorf("got %v, want the connection closed", err)
+	}
+	if rp.IdleClosedConns() != 1 || rp.ExpiredConns() != 0 {
+		t.Errorf("got %d idle, %d expired, want 1, 0", rp.IdleClosedConns(), rp.ExpiredConns())
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	rp := NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "tcp", backendtest.Start(t, nil, backendtest.Echo))
+	rp.SetIdleTimeout(time.Minute)
+	rp.SetMaxLifetime(300 * time.Millisecond)
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	buf := make([]byte, 1)
+	for time.Since(start) < 5*time.Second {
+		conn.Write([]byte("x"))
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("connection closed after %v, want about 300ms", elapsed)
+	}
+	if rp.IdleClosedConns() != 0 || rp.ExpiredConns() != 1 {
+		t.Errorf("got %d idle, %d expired, want 0, 1", rp.IdleClosedConns(), rp.ExpiredConns())
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,378 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultUDPIdleTimeout is how long a UDP session lasts without datagrams in
+// either direction, unless SetIdleTimeout sets otherwise.
+const DefaultUDPIdleTimeout = time.Minute
+
+// DefaultDatagramSize is the size of the largest UDP datagram proxied by
+// default.
+const DefaultDatagramSize = 65535
+
+// DefaultMaxUDPSessions is the most UDP sessions open at once by default.
+const DefaultMaxUDPSessions = 10000
+
+// maxPendingDatagrams is the most datagrams queued for a session while its
+// backend socket is dialed.
+const maxPendingDatagrams = 16
+
+// SetMaxUDPSessions sets the most UDP sessions open at once. The datagrams of
+// new clients over the limit are dropped. Zero means DefaultMaxUDPSessions.
+func (rp *RProxy) SetMaxUDPSessions(n int) {
+	rp.maxSessions = n
+}
+
+// SetDatagramSize sets the size of the largest UDP datagram proxied. Larger
+// datagrams are dropped. Zero means DefaultDatagramSize.
+func (rp *RProxy) SetDatagramSize(n int) {
+	rp.datagramSize = n
+}
+
+// UDPSession describes a client of a udp listener, whose datagrams are
+// forwarded through a socket of its own to a backend.
+type UDPSession struct {
+	Client     net.Addr
+	Backend    *Backend
+	Started    time.Time
+	Uploaded   int64 // bytes from the client to the backend
+	Downloaded int64 // bytes from the backend to the client
+}
+
+// UDPSessions returns the UDP sessions open on the proxy, but for those still
+// dialing their backend.
+func (rp *RProxy) UDPSessions() []UDPSession {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	sessions := make([]UDPSession, 0, len(rp.udpSessions))
+	for _, s := range rp.udpSessions {
+		if s.conn == nil {
+			continue
+		}
+		sessions = append(sessions, UDPSession{
+			Client:     s.client,
+			Backend:    s.backend,
+			Started:    s.started,
+			Uploaded:   atomic.LoadInt64(&s.uploaded),
+			Downloaded: atomic.LoadInt64(&s.downloaded),
+		})
+	}
+	return sessions
+}
+
+type udpSession struct {
+	client     net.Addr
+	backend    *Backend
+	conn       net.Conn // connected to the backend, nil while dialing
+	started    time.Time
+	uploaded   int64
+	downloaded int64
+	activity   int64 // time of the last datagram, in Unix nanoseconds
+
+	// Guarded by the mutex of the proxy
+	pending [][]byte // datagrams received while dialing
+	ended   bool     // no longer forwarding datagrams
+}
+
+// checkUDP checks that the configuration suits a udp listener.
+func (rp *RProxy) checkUDP() error {
+	switch {
+	case len(rp.sniRoutes) > 0 || len(rp.alpnRoutes) > 0:
+		return errors.New("SNI and ALPN routes require a tls or sni listener")
+	case rp.proxyProtocol != 0 || len(rp.trustedProxies) > 0:
+		return errors.New("PROXY protocol not supported for udp")
+	case rp.rateLimit != nil || rp.connLimit != nil || rp.bandwidth != nil:
+		return errors.New("rate, connection, and bandwidth limits not supported for udp")
+	case rp.healthCheck != nil:
+		return errors.New("health checks not supported for udp")
+	case rp.datagramSize < 0:
+		return errors.New("datagram size must not be negative")
+	case rp.maxSessions < 0:
+		return errors.New("max UDP sessions must not be negative")
+	}
+	return nil
+}
+
+func (rp *RProxy) listenUDP() (net.PacketConn, error) {
+	if pc := rp.inheritPacketConn(); pc != nil {
+		return pc, nil
+	}
+	// Resolve network address
+	lAddr, err := net.ResolveUDPAddr("udp", rp.listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp", lAddr)
+}
+
+func (rp *RProxy) maxDatagram() int {
+	if rp.datagramSize > 0 {
+		return rp.datagramSize
+	}
+	return DefaultDatagramSize
+}
+
+func (rp *RProxy) maxUDPSessions() int {
+	if rp.maxSessions > 0 {
+		return rp.maxSessions
+	}
+	return DefaultMaxUDPSessions
+}
+
+// serveUDP forwards the datagrams read from pc to the backend socket of the
+// session of their client, which is opened on its first datagram, until the
+// proxy is closed.
+func (rp *RProxy) serveUDP(pc net.PacketConn) error {
+	defer func() {
+		// The sessions cannot reply once the listener is closed, unless
+		// it was handed over
+		if !rp.isHandedOver() {
+			pc.Close()
+			rp.closeUDPSessions()
+		}
+	}()
+	size := rp.maxDatagram()
+	// One extra byte tells the datagrams over the size
+	buf := make([]byte, size+1)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			if rp.isClosed() {
+				return ErrProxyClosed
+			}
+			rp.logf("read error: %v", err)
+			continue
+		}
+		if n > size {
+			rp.logf("udp: %v: datagram over %d bytes dropped", client, size)
+			continue
+		}
+		if s, conn := rp.udpSession(pc, client, buf[:n]); conn != nil {
+			rp.forwardUDP(s, conn, buf[:n])
+		}
+	}
+}
+
+// udpSession returns the session of client and its backend socket, marking
+// the session active. If the session is still being opened, or there is none
+// and one is opened in the background, datagram p is queued and the socket
+// returned is nil; so it is if the client is not admitted.
+func (rp *RProxy) udpSession(pc net.PacketConn, client net.Addr, p []byte) (*udpSession, net.Conn) {
+	key := client.String()
+	rp.mu.Lock()
+	if s := rp.udpSessions[key]; s != nil && !s.ended {
+		// Marked active under the lock, so that the session cannot time
+		// out before the datagram is forwarded
+		atomic.StoreInt64(&s.activity, time.Now().UnixNano())
+		conn := s.conn
+		if conn == nil && len(s.pending) < maxPendingDatagrams {
+			s.pending = append(s.pending, append([]byte(nil), p...))
+		}
+		rp.mu.Unlock()
+		return s, conn
+	}
+	rp.mu.Unlock()
+	if f := rp.IPFilter(); f != nil && !f.Allowed(client) {
+		atomic.AddInt64(&rp.rejected, 1)
+		rp.logf("ip filter: %v rejected", client)
+		return nil, nil
+	}
+	now := time.Now()
+	s := &udpSession{
+		client:   client,
+		started:  now,
+		activity: now.UnixNano(),
+		pending:  [][]byte{append([]byte(nil), p...)},
+	}
+	rp.mu.Lock()
+	if max := rp.maxUDPSessions(); len(rp.udpSessions) >= max {
+		rp.mu.Unlock()
+		rp.logf("udp: %v: %d sessions open, datagram dropped", client, max)
+		return nil, nil
+	}
+	if rp.udpSessions == nil {
+		rp.udpSessions = make(map[string]*udpSession)
+	}
+	rp.udpSessions[key] = s
+	rp.mu.Unlock()
+	if !rp.begin() {
+		rp.endUDPSession(s)
+		return nil, nil
+	}
+	go rp.openUDPSession(pc, s)
+	return s, nil
+}
+
+// openUDPSession dials the backend socket of session s, forwards the
+// datagrams queued meanwhile, and then the replies until the session ends.
+func (rp *RProxy) openUDPSession(pc net.PacketConn, s *udpSession) {
+	defer rp.inflight.Done()
+	defer rp.endUDPSession(s)
+	b, err := rp.pool.Pick(s.client)
+	if err != nil {
+		rp.logf("serve error: %v", err)
+		return
+	}
+	timeout := rp.dialTimeout
+	if timeout <= 0 {
+		timeout = DefaultDialTimeout
+	}
+	conn, err := net.DialTimeout("udp", b.Addr, timeout)
+	if err != nil {
+		rp.pool.dialFailed(b)
+		rp.logf("serve error: backend %v: %v", b, err)
+		return
+	}
+	if !rp.trackConn(conn) {
+		return
+	}
+	defer rp.untrackConn(conn)
+	b.acquire()
+	defer b.release()
+	rp.mu.Lock()
+	if s.ended {
+		rp.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.backend, s.conn = b, conn
+	pending := s.pending
+	s.pending = nil
+	rp.mu.Unlock()
+	for _, p := range pending {
+		rp.forwardUDP(s, conn, p)
+	}
+	rp.replyUDP(pc, s)
+}
+
+// forwardUDP forwards datagram p of the client of session s to its backend
+// socket conn.
+func (rp *RProxy) forwardUDP(s *udpSession, conn net.Conn, p []byte) {
+	n, err := conn.Write(p)
+	if err != nil {
+		if !errors.Is(err, net.ErrClosed) {
+			rp.logf("write error: %v", err)
+		}
+		return
+	}
+	atomic.AddInt64(&s.uploaded, int64(n))
+	rp.logDatagram(p)
+}
+
+// replyUDP forwards the datagrams read from the backend socket of session s
+// to its client, until the session times out or the socket is closed.
+func (rp *RProxy) replyUDP(pc net.PacketConn, s *udpSession) {
+	size := rp.maxDatagram()
+	buf := make([]byte, size+1)
+	for {
+		now := time.Now()
+		reason, next := rp.checkTimeouts(s.started, time.Unix(0, atomic.LoadInt64(&s.activity)), now)
+		if reason != "" {
+			reason, next = rp.expireUDPSession(s, now)
+		}
+		if reason != "" {
+			if reason == closedIdle {
+				atomic.AddInt64(&rp.idleClosed, 1)
+			} else {
+				atomic.AddInt64(&rp.expired, 1)
+			}
+			rp.logf("connection closed: %v: %s", s.client, reason)
+			return
+		}
+		s.conn.SetReadDeadline(now.Add(next))
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				rp.logf("backend %v: %v", s.backend, err)
+			}
+			return
+		}
+		if n > size {
+			rp.logf("udp: %v: datagram over %d bytes dropped", s.backend, size)
+			continue
+		}
+		atomic.StoreInt64(&s.activity, time.Now().UnixNano())
+		if n, err = pc.WriteTo(buf[:n], s.client); err != nil {
+			return
+		}
+		atomic.AddInt64(&s.downloaded, int64(n))
+		rp.logDatagram(buf[:n])
+	}
+}
+
+// expireUDPSession checks the timeouts of session s again under the lock, so
+// that a datagram from the client marking the session active meanwhile keeps
+// it open, and ends the session if one is reached.
+func (rp *RProxy) expireUDPSession(s *udpSession, now time.Time) (reason string, next time.Duration) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	reason, next = rp.checkTimeouts(s.started, time.Unix(0, atomic.LoadInt64(&s.activity)), now)
+	if reason != "" {
+		rp.removeUDPSession(s)
+	}
+	return reason, next
+}
+
+// endUDPSession removes session s from the session table and closes its
+// backend socket, if any.
+func (rp *RProxy) endUDPSession(s *udpSession) {
+	rp.mu.Lock()
+	rp.removeUDPSession(s)
+	conn := s.conn
+	rp.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// removeUDPSession marks session s ended and removes it from the session
+// table. It must be called with rp.mu held.
+func (rp *RProxy) removeUDPSession(s *udpSession) {
+	s.ended = true
+	key := s.client.String()
+	if rp.udpSessions[key] == s {
+		delete(rp.udpSessions, key)
+	}
+}
+
+func (rp *RProxy) closeUDPSessions() {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	for _, s := range rp.udpSessions {
+		s.ended = true
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	}
+}
+
+// logDatagram logs a datagram in verbose mode.
+func (rp *RProxy) logDatagram(p []byte) {
+	if rp.verbose {
+		rp.logf("%s", p)
+	}
+}
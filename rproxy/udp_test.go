@@ -0,0 +1,155 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func exchange(t *testing.T, conn net.Conn, msg string) (string, error) {
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	return string(buf[:n]), err
+}
+
+func TestUDP(t *testing.T) {
+	rp := NewRProxyWithoutCerts("udp", "127.0.0.1:0", "udp", startUDPEcho(t))
+	rp.SetIdleTimeout(200 * time.Millisecond)
+	rp.SetDatagramSize(8)
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	for _, msg := range []string{"hello", "world"} {
+		if got, err := exchange(t, conn, msg); got != msg {
+			t.Errorf("got %q, %v, want %q", got, err, msg)
+		}
+	}
+	sessions := rp.UDPSessions()
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	if s := sessions[0]; s.Client.String() != conn.LocalAddr().String() || s.Uploaded != 10 || s.Downloaded != 10 {
+		t.Errorf("got session %v, uploaded %d, downloaded %d, want %v, 10, 10", s.Client, s.Uploaded, s.Downloaded, conn.LocalAddr())
+	}
+	if got, err := exchange(t, conn, "too large"); err == nil {
+		t.Errorf("datagram over the size: got %q", got)
+	}
+	// The session expires when idle
+	time.Sleep(400 * time.Millisecond)
+	if n := len(rp.UDPSessions()); n != 0 {
+		t.Errorf("got %d sessions after the idle timeout, want 0", n)
+	}
+	if n := rp.IdleClosedConns(); n != 1 {
+		t.Errorf("got %d idle closed sessions, want 1", n)
+	}
+	if got, err := exchange(t, conn, "again"); got != "again" {
+		t.Errorf("new session: got %q, %v, want again", got, err)
+	}
+}
+
+func TestUDPSessions(t *testing.T) {
+	rp := NewRProxyWithoutCerts("udp", "127.0.0.1:0", "udp", startUDPEcho(t))
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		defer conn.Close()
+		if got, err := exchange(t, conn, "ping"); got != "ping" {
+			t.Fatalf("got %q, %v, want ping", got, err)
+		}
+	}
+	if n := len(rp.UDPSessions()); n != 3 {
+		t.Errorf("got %d sessions, want 3", n)
+	}
+	rp.Close()
+	for i := 0; i < 100 && len(rp.UDPSessions()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(rp.UDPSessions()); n != 0 {
+		t.Errorf("got %d sessions after close, want 0", n)
+	}
+}
+
+func TestUDPMaxSessions(t *testing.T) {
+	rp := NewRProxyWithoutCerts("udp", "127.0.0.1:0", "udp", startUDPEcho(t))
+	rp.SetIdleTimeout(200 * time.Millisecond)
+	rp.SetMaxUDPSessions(1)
+	addr, _ := startProxy(t, rp)
+	defer rp.Close()
+
+	a, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer a.Close()
+	// The datagrams sent while the session opens are all forwarded
+	for _, msg := range []string{"1", "2", "3"} {
+		a.Write([]byte(msg))
+	}
+	for _, msg := range []string{"1", "2", "3"} {
+		a.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		buf := make([]byte, 8)
+		if n, err := a.Read(buf); string(buf[:n]) != msg {
+			t.Errorf("got %q, %v, want %q", buf[:n], err, msg)
+		}
+	}
+	b, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer b.Close()
+	if got, err := exchange(t, b, "over"); err == nil {
+		t.Errorf("session over the limit: got %q", got)
+	}
+	// Once the first session expires, there is room for another
+	time.Sleep(300 * time.Millisecond)
+	if got, err := exchange(t, b, "room"); got != "room" {
+		t.Errorf("got %q, %v, want room", got, err)
+	}
+}
+
+func TestUDPConfig(t *testing.T) {
+	for _, rp := range []*RProxy{
+		NewRProxyWithoutCerts("tcp", "127.0.0.1:0", "udp", "127.0.0.1:1"),
+		NewRProxyWithoutCerts("udp", "127.0.0.1:0", "tcp", "127.0.0.1:1"),
+		NewRProxyWithoutCerts("udp", "127.0.0.1:0", "tls", "127.0.0.1:1"),
+	} {
+		if err := rp.Start(); err == nil || err == ErrProxyClosed {
+			t.Errorf("%s to %v: got %v, want an error", rp.listenProto, rp.Backends()[0], err)
+		}
+	}
+	rp := NewRProxyWithoutCerts("udp", "127.0.0.1:0", "udp", "127.0.0.1:1")
+	rp.SetProxyProtocol(2)
+	if err := rp.Start(); err == nil {
+		t.Errorf("PROXY protocol over udp: got no error")
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// UnixSocket sets the file created by a unix listener.
+type UnixSocket struct {
+	Mode  os.FileMode // permissions, such as 0660; left to the umask if 0
+	Owner string      // user name or ID; unchanged if empty
+	Group string      // group name or ID; unchanged if empty
+}
+
+// SetUnixSocket sets the permissions and ownership of the socket file of a
+// unix listener. Setting the owner usually requires root.
+func (rp *RProxy) SetUnixSocket(s *UnixSocket) {
+	rp.unixSocket = s
+}
+
+// normalizeAddr lowercases addr, except the paths of unix sockets.
+func normalizeAddr(proto, addr string) string {
+	if strings.ToLower(proto) == "unix" {
+		return addr
+	}
+	return strings.ToLower(addr)
+}
+
+// network returns the network dialed for the backend.
+func (b *Backend) network() string {
+	if b.Proto == "unix" {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// listenUnix removes the socket file left behind by a proxy no longer
+// running, if any, and listens on a new one. The file is removed again when
+// the listener is closed.
+func (rp *RProxy) listenUnix() (net.Listener, error) {
+	uid, gid, err := rp.unixSocket.ids()
+	if err != nil {
+		return nil, err
+	}
+	path := rp.listenAddr
+	if rp.sameListen() {
+		// Set the socket file before taking it over, so that a failure
+		// leaves the replaced route serving
+		if err := rp.unixSocket.apply(path, uid, gid); err != nil {
+			return nil, err
+		}
+		if ln := rp.inheritListener(); ln != nil {
+			return ln, nil
+		}
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	// Abstract sockets have no file to set
+	if rp.unixSocket == nil || strings.HasPrefix(path, "@") {
+		return net.Listen("unix", path)
+	}
+	return rp.unixSocket.listen(path, uid, gid)
+}
+
+// listen listens on a socket file at path set as s. The socket is created in
+// a private directory and moved to path once set, so that it is never
+// reachable with the permissions left by the umask.
+func (s *UnixSocket) listen(path string, uid, gid int) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".rproxy")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The file is removed by its final path
+	ln.SetUnlinkOnClose(false)
+	if err := s.apply(tmp, uid, gid); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: ln, path: path}, nil
+}
+
+// unixListener is a unix listener whose socket file was moved to path.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+// Addr returns the address of the socket file at its final path.
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+// Close closes the listener and removes the socket file.
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	if err == nil {
+		os.Remove(l.path)
+	}
+	return err
+}
+
+// apply sets the permissions and ownership of the socket file at path.
+func (s *UnixSocket) apply(path string, uid, gid int) error {
+	// Abstract sockets have no file
+	if s == nil || strings.HasPrefix(path, "@") {
+		return nil
+	}
+	if s.Mode != 0 {
+		if err := os.Chmod(path, s.Mode); err != nil {
+			return err
+		}
+	}
+	if uid >= 0 || gid >= 0 {
+		return os.Chown(path, uid, gid)
+	}
+	return nil
+}
+
+// ids returns the user and group IDs of the owner of the socket file, or -1
+// to leave them unchanged.
+func (s *UnixSocket) ids() (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if s == nil {
+		return
+	}
+	if s.Owner != "" {
+		if uid, err = strconv.Atoi(s.Owner); err != nil {
+			u, err := user.Lookup(s.Owner)
+			if err != nil {
+				return -1, -1, err
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return -1, -1, err
+			}
+		}
+	}
+	if s.Group != "" {
+		if gid, err = strconv.Atoi(s.Group); err != nil {
+			g, err := user.LookupGroup(s.Group)
+			if err != nil {
+				return -1, -1, err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return -1, -1, err
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+// removeStaleSocket removes the socket file at path if no one is listening
+// on it any more. A socket in use, or any other kind of file, is an error and
+// left alone.
+func removeStaleSocket(path string) error {
+	if strings.HasPrefix(path, "@") {
+		return nil
+	}
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("%s may be in use: %v", path, err)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,116 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// author: Cong Ding <dinggnu@gmail.com>
+
+package rproxy
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ccding/go-rproxy/internal/backendtest"
+)
+
+func TestUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Proxy.sock")
+	// A socket file left behind by a proxy no longer running
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	rp := NewRProxyWithoutCerts("unix", path, "unix", backendtest.Start(t, backendtest.Listen(t, "unix", filepath.Join(dir, "Echo.sock")), backendtest.Echo))
+	rp.SetUnixSocket(&UnixSocket{Mode: 0600})
+	startProxy(t, rp)
+	defer rp.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat error: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("mode: got %v, want 0600", fi.Mode().Perm())
+	}
+	// The socket is set up in a private directory, removed once moved
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 2 {
+		t.Errorf("files in %s: got %v, %v, want the two sockets", dir, entries, err)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if line, err := bufio.NewReader(conn).ReadString('\n'); line != "hello\n" {
+		t.Errorf("got %q, %v, want hello", line, err)
+	}
+	// The socket in use is not taken over
+	other := NewRProxyWithoutCerts("unix", path, "tcp", backendtest.Start(t, nil, backendtest.Echo))
+	if err := other.Start(); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("socket in use: got %v", err)
+	}
+	rp.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left after close: %v", err)
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := removeStaleSocket(path); err != nil {
+		t.Errorf("missing file: got %v", err)
+	}
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if err := removeStaleSocket(path); err == nil {
+		t.Errorf("regular file: got no error")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("regular file removed: %v", err)
+	}
+}
+
+func TestUnixClientIP(t *testing.T) {
+	// Clients of unix listeners have no IP address to check
+	tests := []struct {
+		name string
+		set  func(rp *RProxy)
+	}{
+		{"ip filter", func(rp *RProxy) { rp.SetIPFilter(&IPFilter{}) }},
+		{"PROXY headers", func(rp *RProxy) {
+			rp.SetAcceptProxyProtocol([]*net.IPNet{{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}})
+		}},
+		{"rate limit", func(rp *RProxy) {
+			rp.SetRateLimit(&RateLimit{Rate: 1, Burst: 1, Key: RateLimitIP, Policy: RateLimitReject})
+		}},
+	}
+	for _, tt := range tests {
+		rp := NewRProxyWithoutCerts("unix", filepath.Join(t.TempDir(), "proxy.sock"), "tcp", "127.0.0.1:1")
+		tt.set(rp)
+		if err := rp.Start(); err == nil || !strings.Contains(err.Error(), "unix") {
+			t.Errorf("%s: got %v, want an error", tt.name, err)
+		}
+	}
+}
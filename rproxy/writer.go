@@ -40,3 +40,19 @@ func (r *RPWriteCloser) Write(p []byte) (int, error) {
 func (r *RPWriteCloser) Close() error {
 	return r.Closer.Close()
 }
+
+// CloseWrite shuts down the writing side of the connection, so the peer sees
+// EOF while data can still be read. If the connection does not support
+// half-close, it is closed entirely.
+func (r *RPWriteCloser) CloseWrite() error {
+	if cw, ok := r.Closer.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return r.Closer.Close()
+}
+
+// closeWriter is implemented by connections supporting half-close, such as
+// *net.TCPConn and *tls.Conn.
+type closeWriter interface {
+	CloseWrite() error
+}